@@ -2,6 +2,7 @@ package memconn
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 )
 
@@ -16,6 +17,16 @@ const (
 	// of the connected pipe.
 	networkMemu = "memu"
 
+	// networkShmb is a buffered network connection between processes
+	// on the same host using shared memory. It is only supported on
+	// Linux.
+	networkShmb = "shmb"
+
+	// networkShmu is an unbuffered network connection between
+	// processes on the same host using shared memory. It is only
+	// supported on Linux.
+	networkShmu = "shmu"
+
 	// addrLocalhost is a reserved address name. It is used when a
 	// Listen variant omits the local address or a Dial variant omits
 	// the remote address.
@@ -39,10 +50,24 @@ func MapNetwork(from, to string) {
 	provider.MapNetwork(from, to)
 }
 
+// NewChild returns a new Provider with its own namespace whose dials
+// fall back to the listeners created with the package-level functions.
+//
+// Please see Provider.NewChild for more information.
+func NewChild() *Provider {
+	return provider.NewChild()
+}
+
 // Listen begins listening at address for the specified network.
 //
 // Known networks are "memb" (memconn buffered) and "memu" (memconn unbuffered).
 //
+// On Linux the networks "shmb" (shared memory buffered) and "shmu"
+// (shared memory unbuffered) connect processes on the same host. Their
+// listener names are shared by all of the current user's processes.
+//
+// Please see Provider.Listen for the features they do not support.
+//
 // When the specified address is already in use on the specified
 // network an error is returned.
 //
@@ -66,6 +91,12 @@ func ListenMem(network string, laddr *Addr) (*Listener, error) {
 //
 // Known networks are "memb" (memconn buffered) and "memu" (memconn unbuffered).
 //
+// On Linux the networks "shmb" (shared memory buffered) and "shmu"
+// (shared memory unbuffered) connect processes on the same host. Their
+// listener names are shared by all of the current user's processes.
+//
+// Please see Provider.Listen for the features they do not support.
+//
 // When the provided network is unknown the operation defers to
 // net.Dial.
 func Dial(network, address string) (net.Conn, error) {
@@ -108,3 +139,37 @@ func DialMemContext(
 
 	return provider.DialMemContext(ctx, network, laddr, raddr)
 }
+
+// CA returns the CertAuthority used by the package-level ListenTLS and
+// DialTLS functions.
+//
+// Please see Provider.CA for more information.
+func CA() (*CertAuthority, error) {
+	return provider.CA()
+}
+
+// ListenTLS begins listening at address for the specified network and
+// returns a listener that wraps accepted connections in TLS.
+//
+// Please see Provider.ListenTLS for more information.
+func ListenTLS(network, address string) (net.Listener, error) {
+	return provider.ListenTLS(network, address)
+}
+
+// DialTLS dials a named connection and performs the TLS handshake.
+//
+// Please see Provider.DialTLS for more information.
+func DialTLS(network, address string) (*tls.Conn, error) {
+	return provider.DialTLS(network, address)
+}
+
+// DialTLSContext dials a named connection and performs the TLS
+// handshake using a Go context to provide timeout behavior.
+//
+// Please see Provider.DialTLS for more information.
+func DialTLSContext(
+	ctx context.Context,
+	network, address string) (*tls.Conn, error) {
+
+	return provider.DialTLSContext(ctx, network, address)
+}
@@ -11,7 +11,7 @@ type Addr struct {
 // Buffered indicates whether or not the address refers to a buffered
 // network type.
 func (a Addr) Buffered() bool {
-	return a.network == networkMemb
+	return a.network == networkMemb || a.network == networkShmb
 }
 
 // Network returns the address's network.
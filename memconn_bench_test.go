@@ -2,6 +2,8 @@ package memconn_test
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"testing"
@@ -31,6 +33,12 @@ func BenchmarkMembWithDeadline(b *testing.B) {
 		})
 }
 
+// BenchmarkMembStream measures the throughput of many small, buffered
+// writes over a single connection.
+func BenchmarkMembStream(b *testing.B) {
+	benchmarkStream(b, "memb", 0)
+}
+
 func BenchmarkMemu(b *testing.B) {
 	addr := fmt.Sprintf("%d", time.Now().UnixNano())
 	lis := serve(b, memconn.Listen, "memu", addr, 0, 0, false)
@@ -52,6 +60,93 @@ func BenchmarkMemuWithDeadline(b *testing.B) {
 		})
 }
 
+func BenchmarkMemuStream(b *testing.B) {
+	benchmarkStream(b, "memu", 0)
+}
+
+// BenchmarkMemuStreamReadBuffer measures the throughput of many small
+// writes to a connection whose remote side has a receive buffer.
+func BenchmarkMemuStreamReadBuffer(b *testing.B) {
+	benchmarkStream(b, "memu", 64*1024)
+}
+
+// BenchmarkMemuReadFrom measures ReadFrom copying large chunks to a
+// connection whose remote side has no receive buffer.
+func BenchmarkMemuReadFrom(b *testing.B) {
+	p := &memconn.Provider{}
+	defer p.Close()
+	addr := &memconn.Addr{Name: "server"}
+	lis, err := p.ListenMem("memu", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer lis.Close()
+	client, err := p.DialMem("memu", nil, addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+	server, err := lis.AcceptMemConn()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer server.Close()
+	go io.Copy(ioutil.Discard, server)
+
+	r := &chunkReader{n: b.N, chunk: make([]byte, 32*1024)}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(r.chunk)))
+	b.ResetTimer()
+	if _, err := client.ReadFrom(r); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// chunkReader returns chunk from each of n Read operations.
+type chunkReader struct {
+	n     int
+	chunk []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	r.n--
+	return copy(p, r.chunk), nil
+}
+
+// BenchmarkMemuDial measures the cost of dialing, accepting, and closing
+// a connection, which includes tracking the connection for the
+// Provider's Leaks, Close, and Partition functions.
+func BenchmarkMemuDial(b *testing.B) {
+	p := &memconn.Provider{}
+	defer p.Close()
+	addr := &memconn.Addr{Name: "server"}
+	lis, err := p.ListenMem("memu", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer lis.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			client, err := p.DialMem("memu", nil, addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			server, err := lis.AcceptMemConn()
+			if err != nil {
+				b.Fatal(err)
+			}
+			client.Close()
+			server.Close()
+		}
+	})
+}
+
 func BenchmarkTCP(b *testing.B) {
 	lis := serve(b, net.Listen, "tcp", "127.0.0.1:", 0, 0, false)
 	benchmarkNetConnParallel(b, lis, net.Dial)
@@ -131,3 +226,45 @@ func writeBenchmarkData(
 		c.SetLinger(0)
 	}
 }
+
+func benchmarkStream(b *testing.B, network string, rbuf int) {
+	addr := fmt.Sprintf("%d", time.Now().UnixNano())
+	lis, err := memconn.Listen(network, addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer lis.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if rbuf > 0 {
+			c.(*memconn.Conn).SetReadBuffer(rbuf)
+		}
+		io.Copy(ioutil.Discard, c)
+	}()
+
+	client, err := memconn.Dial(network, addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(fixedData)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(fixedData); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if c, ok := client.(*memconn.Conn); ok {
+		c.SetCloseTimeout(time.Duration(1) * time.Minute)
+	}
+	client.Close()
+	<-done
+}
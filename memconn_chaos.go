@@ -0,0 +1,376 @@
+package memconn
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ChaosConfig configures the faults injected by a Provider's chaos mode.
+//
+// Please see the Provider's SetChaos function for more information.
+type ChaosConfig struct {
+	// Seed seeds the random decisions of chaos mode. If zero then a
+	// seed is chosen using the current time. The seed is logged when
+	// chaos mode is enabled so a failing run can be replayed.
+	Seed int64
+
+	// ResetRate, StallRate, and SlowRate are the average number of times
+	// per second that each connection is reset, stalled, or slowed.
+	ResetRate float64
+	StallRate float64
+	SlowRate  float64
+
+	// RefuseRate is the fraction of dials that are refused with
+	// ErrConnRefused, from zero to one.
+	RefuseRate float64
+
+	// StallDuration is how long a connection remains stalled. The
+	// default is 100ms.
+	StallDuration time.Duration
+
+	// SlowDuration is how long a connection remains slow, and SlowDelay
+	// is how long each Read and Write operation is delayed while the
+	// connection is slow. The defaults are one second and 10ms.
+	SlowDuration time.Duration
+	SlowDelay    time.Duration
+
+	// Logf is called with a description of each injected fault. The
+	// Logf function of testing.TB may be used. If nil then the faults
+	// are only recorded. Please see the Provider's ChaosEvents function
+	// for more information.
+	Logf func(format string, args ...interface{})
+}
+
+// ChaosEvent describes a fault injected by a Provider's chaos mode.
+type ChaosEvent struct {
+	// Kind is "refuse", "reset", "stall", or "slow".
+	Kind string
+
+	// Dial is the number of the dial that was refused, or that created
+	// the affected connection. Dials are numbered in the order in which
+	// they are made with the Provider, starting at one when chaos mode
+	// is enabled.
+	Dial uint64
+
+	// LocalAddr and RemoteAddr are the addresses of the dialer and the
+	// listener.
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+
+	// At is the time of the fault relative to when chaos mode was
+	// enabled, according to the Provider's Clock.
+	At time.Duration
+
+	// Duration is how long the connection is stalled or slowed.
+	Duration time.Duration
+}
+
+// String returns a description of the event.
+func (e ChaosEvent) String() string {
+	s := fmt.Sprintf("chaos: %s dial %d %s->%s at %s",
+		e.Kind, e.Dial, e.LocalAddr, e.RemoteAddr, e.At)
+	if e.Duration > 0 {
+		s += fmt.Sprintf(" for %s", e.Duration)
+	}
+	return s
+}
+
+// chaosSeedStride is the prime by which the number of a dial is
+// multiplied and added to the configured seed to seed the faults of the
+// dial's connection. A large stride prevents the connections of runs
+// whose seeds differ by less than the stride from sharing faults, as
+// would happen for seed 1's second dial and seed 2's first dial if the
+// number of the dial were added as it is.
+const chaosSeedStride = 1000003
+
+type chaosOptions struct {
+	sync.Mutex
+	state *chaosState
+}
+
+// chaosState is the state of a Provider's chaos mode from the time it is
+// enabled until it is disabled.
+type chaosState struct {
+	cfg   ChaosConfig
+	clock Clock
+	start time.Time
+
+	// rng decides which dials are refused, and dials is the number of
+	// dials made since chaos mode was enabled
+	rng   *rand.Rand
+	dials uint64
+
+	events  []ChaosEvent
+	stopped bool
+
+	// scheds are the schedules of the connections into which faults
+	// are injected
+	scheds map[*chaosSched]struct{}
+
+	// mu guards rng, dials, events, stopped, and scheds
+	mu sync.Mutex
+}
+
+// chaosSched is the schedule of the faults injected into a connection.
+// Only the timer of the next fault, or of the end of the current fault,
+// is pending at any time.
+type chaosSched struct {
+	state *chaosState
+	link  *link
+	timer Timer
+
+	// slowed indicates whether or not the connection is slowed by the
+	// current fault
+	slowed  bool
+	stopped bool
+
+	// mu guards timer, slowed, and stopped, and is held while a fault
+	// is injected so it cannot race with stop
+	mu sync.Mutex
+}
+
+// SetChaos enables chaos mode, in which faults are injected at random
+// into the dials made with this Provider and the connections they
+// create. Passing nil disables chaos mode.
+//
+// The faults are random but reproducible. Whether or not a dial is
+// refused depends only on the seed and the number of the dial, and the
+// times at which a connection is reset, stalled, or slowed depend only
+// on the seed and the number of the dial that created the connection.
+// Therefore a run whose dials are made in the same order injects the
+// same faults when replayed with the same seed, and with a Clock that is
+// advanced manually, at the same times.
+//
+// A stalled connection behaves like a connection across a partition, and
+// a reset connection fails its operations with ErrConnReset. Please see
+// the Partition function for more information.
+//
+// Chaos mode uses the Clock that the Provider uses when SetChaos is
+// called.
+func (p *Provider) SetChaos(cfg *ChaosConfig) {
+	p.chaos.Lock()
+	defer p.chaos.Unlock()
+
+	if old := p.chaos.state; old != nil {
+		old.stop()
+	}
+	if cfg == nil {
+		return
+	}
+
+	s := &chaosState{cfg: *cfg, clock: p.getClock()}
+	if s.cfg.Seed == 0 {
+		s.cfg.Seed = time.Now().UnixNano()
+	}
+	if s.cfg.StallDuration <= 0 {
+		s.cfg.StallDuration = 100 * time.Millisecond
+	}
+	if s.cfg.SlowDuration <= 0 {
+		s.cfg.SlowDuration = time.Second
+	}
+	if s.cfg.SlowDelay <= 0 {
+		s.cfg.SlowDelay = 10 * time.Millisecond
+	}
+	s.start = s.clock.Now()
+	s.rng = rand.New(rand.NewSource(s.cfg.Seed))
+	s.logf("chaos: enabled with seed %d", s.cfg.Seed)
+	p.chaos.state = s
+}
+
+// ChaosEvents returns the faults injected since chaos mode was last
+// enabled, in the order in which they were injected.
+func (p *Provider) ChaosEvents() []ChaosEvent {
+	p.chaos.Lock()
+	s := p.chaos.state
+	p.chaos.Unlock()
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ChaosEvent(nil), s.events...)
+}
+
+// chaosDial numbers a dial and decides whether or not chaos mode refuses
+// it. The returned state is nil if chaos mode is disabled.
+func (p *Provider) chaosDial(laddr, raddr Addr) (*chaosState, uint64, bool) {
+	p.chaos.Lock()
+	s := p.chaos.state
+	p.chaos.Unlock()
+	if s == nil {
+		return nil, 0, false
+	}
+
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return nil, 0, false
+	}
+	s.dials++
+	n := s.dials
+	refuse := s.rng.Float64() < s.cfg.RefuseRate
+	s.mu.Unlock()
+
+	if refuse {
+		s.record(ChaosEvent{
+			Kind:       "refuse",
+			Dial:       n,
+			LocalAddr:  laddr,
+			RemoteAddr: raddr,
+		})
+	}
+	return s, n, refuse
+}
+
+func (s *chaosState) logf(format string, args ...interface{}) {
+	if s.cfg.Logf != nil {
+		s.cfg.Logf(format, args...)
+	}
+}
+
+// stop disables the chaos mode and stops injecting faults into the
+// connections.
+func (s *chaosState) stop() {
+	s.mu.Lock()
+	s.stopped = true
+	scheds := s.scheds
+	s.scheds = nil
+	s.mu.Unlock()
+	for cs := range scheds {
+		cs.stop()
+	}
+}
+
+// add adds the schedule to the chaos mode. A flag is returned indicating
+// whether or not the schedule was added, which it is not once the chaos
+// mode is disabled.
+func (s *chaosState) add(cs *chaosSched) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return false
+	}
+	if s.scheds == nil {
+		s.scheds = map[*chaosSched]struct{}{}
+	}
+	s.scheds[cs] = struct{}{}
+	return true
+}
+
+func (s *chaosState) remove(cs *chaosSched) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.scheds, cs)
+}
+
+// record records and logs the event.
+func (s *chaosState) record(e ChaosEvent) {
+	e.At = s.clock.Now().Sub(s.start)
+	s.mu.Lock()
+	s.events = append(s.events, e)
+	s.mu.Unlock()
+	s.logf("%s", e)
+}
+
+// schedule injects faults into the connection created by the dial with
+// the provided number until the connection is closed or chaos mode is
+// disabled. The connection has its own random number generator, so its
+// faults do not depend on when other connections are created.
+func (s *chaosState) schedule(c *Conn, n uint64) {
+	rate := s.cfg.ResetRate + s.cfg.StallRate + s.cfg.SlowRate
+	if rate <= 0 {
+		return
+	}
+	rng := rand.New(rand.NewSource(s.cfg.Seed + int64(n)*chaosSeedStride))
+	l := c.link
+	cs := &chaosSched{state: s, link: l}
+	if !s.add(cs) {
+		return
+	}
+	if !l.setChaos(cs) {
+		s.remove(cs)
+		return
+	}
+
+	// Each fault is scheduled once the previous fault ends, so rng is
+	// never used concurrently.
+	var next func()
+	next = func() {
+		wait := time.Duration(rng.ExpFloat64() / rate * float64(time.Second))
+		cs.after(wait, func() {
+			cs.mu.Lock()
+			if cs.stopped {
+				cs.mu.Unlock()
+				return
+			}
+			e := ChaosEvent{Dial: n, LocalAddr: c.laddr, RemoteAddr: c.raddr}
+			switch x := rng.Float64() * rate; {
+			case x < s.cfg.ResetRate:
+				// The schedule is stopped by closing the connection,
+				// so the lock is released first.
+				e.Kind = "reset"
+				s.record(e)
+				cs.mu.Unlock()
+				l.resetConns()
+				return
+			case x < s.cfg.ResetRate+s.cfg.StallRate:
+				e.Kind, e.Duration = "stall", s.cfg.StallDuration
+				s.record(e)
+				l.stall(s)
+				cs.timer = s.clock.AfterFunc(e.Duration, func() {
+					l.unstall(s)
+					next()
+				})
+			default:
+				e.Kind, e.Duration = "slow", s.cfg.SlowDuration
+				s.record(e)
+				l.setDelay(s.cfg.SlowDelay)
+				cs.slowed = true
+				cs.timer = s.clock.AfterFunc(e.Duration, func() {
+					cs.mu.Lock()
+					cs.slowed = false
+					cs.mu.Unlock()
+					l.setDelay(0)
+					next()
+				})
+			}
+			cs.mu.Unlock()
+		})
+	}
+	next()
+}
+
+// after schedules f unless the schedule is stopped.
+func (cs *chaosSched) after(d time.Duration, f func()) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if !cs.stopped {
+		cs.timer = cs.state.clock.AfterFunc(d, f)
+	}
+}
+
+// stop stops injecting faults into the connection and ends the current
+// fault. The pending timer is stopped so neither it nor the connection
+// is retained once the connection is closed or chaos mode is disabled.
+func (cs *chaosSched) stop() {
+	cs.mu.Lock()
+	if cs.stopped {
+		cs.mu.Unlock()
+		return
+	}
+	cs.stopped = true
+	if cs.timer != nil {
+		cs.timer.Stop()
+	}
+	slowed := cs.slowed
+	cs.mu.Unlock()
+
+	cs.link.unstall(cs.state)
+	if slowed {
+		cs.link.setDelay(0)
+	}
+	cs.state.remove(cs)
+}
@@ -0,0 +1,195 @@
+package memconn_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akutz/memconn"
+)
+
+// runChaos dials a listener several times with chaos mode enabled and
+// returns the logged events.
+func runChaos(t *testing.T, seed int64) []string {
+	p := &memconn.Provider{}
+	defer p.Close()
+	clock := newFakeClock()
+	p.SetClock(clock)
+
+	lis, err := p.ListenMem("memb", &memconn.Addr{Name: "server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, err := lis.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var logged []string
+	p.SetChaos(&memconn.ChaosConfig{
+		Seed:       seed,
+		ResetRate:  0.2,
+		StallRate:  1,
+		SlowRate:   1,
+		RefuseRate: 0.3,
+		Logf: func(format string, args ...interface{}) {
+			logged = append(logged, fmt.Sprintf(format, args...))
+		},
+	})
+
+	for i := 0; i < 10; i++ {
+		_, err := p.DialMem(
+			"memb",
+			&memconn.Addr{Name: fmt.Sprintf("client-%d", i)},
+			&memconn.Addr{Name: "server"})
+		if err != nil && !errors.Is(err, memconn.ErrConnRefused) {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		clock.Advance(100 * time.Millisecond)
+	}
+
+	events := p.ChaosEvents()
+	if len(events) == 0 || len(logged) != len(events)+1 {
+		t.Fatalf("unexpected events: %d logged, %d recorded", len(logged), len(events))
+	}
+	for i, e := range events {
+		if logged[i+1] != e.String() {
+			t.Fatalf("event %d: logged %q, recorded %q", i, logged[i+1], e)
+		}
+	}
+	return logged
+}
+
+// TestChaosReplay validates that chaos mode injects the same faults when
+// it is replayed with the same seed.
+func TestChaosReplay(t *testing.T) {
+	a, b := runChaos(t, 1), runChaos(t, 1)
+	if !reflect.DeepEqual(a, b) {
+		t.Fatalf("replay differs:\n%q\n%q", a, b)
+	}
+	kinds := map[string]bool{}
+	for _, s := range a {
+		for _, k := range []string{"refuse", "reset", "stall", "slow"} {
+			if strings.HasPrefix(s, "chaos: "+k+" ") {
+				kinds[k] = true
+			}
+		}
+	}
+	if len(kinds) != 4 {
+		t.Fatalf("expected every kind of fault: %q", a)
+	}
+	if c := runChaos(t, 2); reflect.DeepEqual(a, c) {
+		t.Fatal("different seeds injected the same faults")
+	}
+}
+
+func TestChaosReset(t *testing.T) {
+	p := &memconn.Provider{}
+	defer p.Close()
+	lis, err := p.ListenMem("memu", &memconn.Addr{Name: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetChaos(&memconn.ChaosConfig{Seed: 1, ResetRate: 100})
+	_, c2 := dialPartitionPair(t, p, "memu", lis, "a")
+
+	if _, err := c2.Read(make([]byte, 1)); !errors.Is(err, memconn.ErrConnReset) {
+		t.Fatalf("expected reset error: %v", err)
+	}
+	if events := p.ChaosEvents(); len(events) != 1 || events[0].Kind != "reset" {
+		t.Fatalf("unexpected events: %v", events)
+	}
+}
+
+func TestChaosStall(t *testing.T) {
+	p := &memconn.Provider{}
+	defer p.Close()
+	clock := newFakeClock()
+	p.SetClock(clock)
+	lis, err := p.ListenMem("memb", &memconn.Addr{Name: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetChaos(&memconn.ChaosConfig{
+		Seed:          1,
+		StallRate:     100,
+		StallDuration: time.Hour,
+	})
+	c1, c2 := dialPartitionPair(t, p, "memb", lis, "a")
+	clock.Advance(time.Second)
+
+	if _, err := c1.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(c2, buf)
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		t.Fatalf("read did not stall: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// The read proceeds once the stall ends, and disabling chaos mode
+	// prevents further faults.
+	p.SetChaos(nil)
+	clock.Advance(time.Hour)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("invalid data: %q", buf)
+	}
+}
+
+// TestChaosStopsTimers validates that the timers scheduling the faults
+// of a connection are stopped when the connection is closed and when
+// chaos mode is disabled.
+func TestChaosStopsTimers(t *testing.T) {
+	p := &memconn.Provider{}
+	defer p.Close()
+	clock := newFakeClock()
+	p.SetClock(clock)
+	lis, err := p.ListenMem("memb", &memconn.Addr{Name: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetChaos(&memconn.ChaosConfig{
+		Seed:         1,
+		SlowRate:     100,
+		SlowDuration: time.Hour,
+	})
+
+	c1, c2 := dialPartitionPair(t, p, "memb", lis, "a")
+	if n := clock.pending(); n != 1 {
+		t.Fatalf("unexpected pending timers: %d", n)
+	}
+	c1.Close()
+	c2.Close()
+	if n := clock.pending(); n != 0 {
+		t.Fatalf("timers pending after close: %d", n)
+	}
+
+	// Disabling chaos mode stops the timers and ends the slow fault.
+	dialPartitionPair(t, p, "memb", lis, "c")
+	clock.Advance(time.Second)
+	if n := clock.pending(); n != 1 {
+		t.Fatalf("unexpected pending timers: %d", n)
+	}
+	p.SetChaos(nil)
+	if n := clock.pending(); n != 0 {
+		t.Fatalf("timers pending after disabling chaos: %d", n)
+	}
+}
@@ -0,0 +1,39 @@
+package memconn
+
+import "time"
+
+// Clock is the interface used by a Provider to tell time and to schedule
+// the timers used for deadlines and close timeouts. A Clock that is
+// advanced manually enables tests to exercise deadlines without waiting
+// on real time.
+//
+// Please see the Provider's SetClock function for more information.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// AfterFunc waits for the duration to elapse and then calls f in
+	// its own goroutine. The returned Timer can be used to cancel the
+	// call using its Stop method.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer returned by a Clock's AfterFunc function.
+type Timer interface {
+	// Stop prevents the Timer from firing. It returns true if the call
+	// stops the timer, false if the timer has already expired or been
+	// stopped.
+	Stop() bool
+}
+
+// realClock is a Clock backed by the functions from the Go stdlib "time"
+// package. It is the default Clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
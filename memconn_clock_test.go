@@ -0,0 +1,197 @@
+package memconn_test
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akutz/memconn"
+)
+
+// fakeClock is a memconn.Clock that only moves when advanced.
+type fakeClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	when  time.Time
+	f     func()
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) memconn.Timer {
+	c.Lock()
+	defer c.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d and calls the functions of the
+// timers that expire in the order in which they expire.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	c.now = c.now.Add(d)
+	var expired, pending []*fakeTimer
+	for _, t := range c.timers {
+		if t.when.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			expired = append(expired, t)
+		}
+	}
+	c.timers = pending
+	c.Unlock()
+
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].when.Before(expired[j].when)
+	})
+	for _, t := range expired {
+		t.f()
+	}
+}
+
+// waitForTimers blocks until at least n timers are pending.
+func (c *fakeClock) waitForTimers(n int) {
+	for {
+		c.Lock()
+		pending := len(c.timers)
+		c.Unlock()
+		if pending >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// pending returns the number of pending timers.
+func (c *fakeClock) pending() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.timers)
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	for i, ot := range t.clock.timers {
+		if ot == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// TestClockDeadline validates that read and write deadlines use the
+// Provider's clock.
+func TestClockDeadline(t *testing.T) {
+	clock := newFakeClock()
+	p := &memconn.Provider{}
+	p.SetClock(clock)
+
+	lis, err := p.ListenMem("memu", &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	client, err := p.DialMem("memu", nil, &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.SetDeadline(clock.Now().Add(time.Hour))
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := client.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := client.Write(fixedData)
+		writeErr <- err
+	}()
+
+	select {
+	case err := <-readErr:
+		t.Fatalf("read returned before the deadline: %v", err)
+	case err := <-writeErr:
+		t.Fatalf("write returned before the deadline: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clock.Advance(time.Hour)
+	for _, err := range []error{<-readErr, <-writeErr} {
+		if opErr, ok := err.(*net.OpError); !ok || !opErr.Timeout() {
+			t.Fatalf("timeout should have occurred: %v", err)
+		}
+	}
+
+	// A deadline in the past relative to the clock times out
+	// immediately.
+	client.SetReadDeadline(clock.Now().Add(-time.Second))
+	_, err = client.Read(make([]byte, 1))
+	if opErr, ok := err.(*net.OpError); !ok || !opErr.Timeout() {
+		t.Fatalf("timeout should have occurred: %v", err)
+	}
+}
+
+// TestClockCloseTimeout validates that the close timeout of buffered
+// connections uses the Provider's clock.
+func TestClockCloseTimeout(t *testing.T) {
+	clock := newFakeClock()
+	p := &memconn.Provider{}
+	p.SetClock(clock)
+
+	lis, err := p.ListenMem("memb", &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	client, err := p.DialMem("memb", nil, &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := lis.AcceptMemConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// The server never reads the data so the close timeout elapses.
+	client.SetCloseTimeout(time.Hour)
+	if _, err := client.Write(fixedData); err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		client.Close()
+		close(closed)
+	}()
+
+	clock.waitForTimers(1)
+	select {
+	case <-closed:
+		t.Fatal("close returned before the close timeout")
+	default:
+	}
+
+	clock.Advance(time.Hour)
+	<-closed
+}
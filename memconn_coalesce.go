@@ -0,0 +1,414 @@
+package memconn
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultCoalesceDelay is the default time for which small writes
+	// are coalesced. It is the delay with which Linux acknowledges TCP
+	// segments when delayed acknowledgements are enabled.
+	defaultCoalesceDelay = 40 * time.Millisecond
+
+	// defaultCoalesceSize is the default size at which coalesced writes
+	// are sent. It is the maximum segment size of TCP over Ethernet.
+	defaultCoalesceSize = 1460
+)
+
+// coalescer coalesces consecutive small writes to a connection like
+// Nagle's algorithm. A write is sent immediately unless data sent
+// earlier is still unacknowledged, in which case the write is held.
+// Data is acknowledged once the delay passes after it is sent. The held
+// data is sent as a single write once the data sent earlier is
+// acknowledged, or as soon as the held data reaches the size threshold.
+type coalescer struct {
+	// enabled is non-zero while coalescing is enabled or held data
+	// remains to be sent. It is read without holding mu so writes to
+	// connections without coalescing remain cheap.
+	enabled int32
+
+	// noDelay indicates whether or not coalescing was disabled. Writes
+	// are still held while the data held earlier is sent, so they are
+	// not sent before it.
+	noDelay bool
+
+	delay time.Duration
+	size  int
+
+	// held is the data waiting to be sent
+	held []byte
+
+	// sending indicates whether or not data is being sent, either by a
+	// Write operation or by the goroutine that sends the held data, and
+	// direct indicates the data is being sent by a Write operation
+	sending bool
+	direct  bool
+
+	// closing indicates the connection is being closed. Write operations
+	// fail once closing is set, and no longer wait for the held data.
+	closing bool
+
+	// unacked indicates whether or not data was sent less than delay
+	// ago, ack is the timer that acknowledges the data, and gen
+	// identifies the timer
+	unacked bool
+	ack     Timer
+	gen     uint64
+
+	// force indicates whether or not the held data should be sent
+	// without waiting for an acknowledgement, such as when the
+	// connection is flushed
+	force bool
+
+	// err is the error that occurred while sending held data. Once set,
+	// err is returned by subsequent calls to Write and Flush.
+	err error
+
+	// changed is closed and replaced each time the held data is sent
+	// or discarded
+	changed chan struct{}
+
+	// mu guards all of the fields, and enabled is only changed while
+	// mu is held
+	mu sync.Mutex
+}
+
+// notify wakes up the goroutines waiting on changed. The caller must
+// hold mu.
+func (w *coalescer) notify() {
+	if w.changed != nil {
+		close(w.changed)
+	}
+	w.changed = make(chan struct{})
+}
+
+func (w *coalescer) isEnabled() bool {
+	return atomic.LoadInt32(&w.enabled) != 0
+}
+
+// setLocked enables or disables coalescing. The caller must hold mu.
+func (w *coalescer) setLocked(noDelay bool) {
+	w.noDelay = noDelay
+	if !noDelay {
+		atomic.StoreInt32(&w.enabled, 1)
+	}
+	w.idleLocked()
+}
+
+// idleLocked stops routing writes through the coalescer once coalescing
+// is disabled and no held data remains. The caller must hold mu.
+func (w *coalescer) idleLocked() {
+	if w.noDelay && !w.sending && len(w.held) == 0 {
+		atomic.StoreInt32(&w.enabled, 0)
+	}
+}
+
+// SetNoDelay controls whether or not consecutive small writes to the
+// connection are coalesced, like the function of the same name on
+// *net.TCPConn. The default is true, which means every Write operation
+// is sent to the remote side of the connection as it is.
+//
+// When noDelay is false, a Write operation is sent immediately unless
+// data sent earlier has not yet been acknowledged. Otherwise the data is
+// held and the Write operation returns without waiting for the data to
+// be read, even if the connection is unbuffered. The held data is sent
+// as a single write once the earlier data is acknowledged, which happens
+// 40ms after the data is sent, or as soon as 1460 bytes are held. This
+// emulates Nagle's algorithm interacting with delayed acknowledgements,
+// and lets the remote side read the data of several writes at once.
+// While that much data is held, Write operations block until it is sent.
+// Please see the SetCoalescing function to change the delay and size.
+//
+// An error that occurs while sending held data is returned by the next
+// call to Write or Flush. Close sends the held data without delay. A
+// buffered connection sends it within the connection's close timeout.
+// Close on an unbuffered connection waits until the held data is read,
+// the remote side of the connection is closed, or the coalescing delay
+// passes, which is as long as the remote side has to acknowledge data.
+// Held data that is not read by then is discarded. Close does not wait
+// for a pending Write operation, which fails once the connection is
+// closed, and in that case the held data is discarded as well.
+func (c *Conn) SetNoDelay(noDelay bool) error {
+	c.coalesce.mu.Lock()
+	defer c.coalesce.mu.Unlock()
+	if c.coalesce.delay == 0 {
+		c.coalesce.delay = defaultCoalesceDelay
+		c.coalesce.size = defaultCoalesceSize
+	}
+	c.coalesce.setLocked(noDelay)
+	c.sendHeldLocked()
+	return nil
+}
+
+// SetCoalescing coalesces consecutive small writes to the connection for
+// up to the provided delay, or until the provided number of bytes is
+// held. Calling SetCoalescing is the same as calling SetNoDelay(false)
+// with a different delay and size. A delay or size that is not positive
+// uses the default.
+//
+// Please see the SetNoDelay function for more information.
+func (c *Conn) SetCoalescing(delay time.Duration, size int) {
+	if delay <= 0 {
+		delay = defaultCoalesceDelay
+	}
+	if size <= 0 {
+		size = defaultCoalesceSize
+	}
+	c.coalesce.mu.Lock()
+	defer c.coalesce.mu.Unlock()
+	c.coalesce.delay, c.coalesce.size = delay, size
+	c.coalesce.setLocked(false)
+	c.sendHeldLocked()
+}
+
+// writeCoalesced sends b immediately if no data is unacknowledged, and
+// otherwise holds b to be sent with the other held data. If the held data
+// already reached the size threshold then writeCoalesced blocks until it
+// is sent, like a Write to a TCP connection whose send buffer is full.
+func (c *Conn) writeCoalesced(b []byte) (int, error) {
+	w := &c.coalesce
+	w.mu.Lock()
+	for {
+		switch {
+		case w.err != nil:
+			err := w.err
+			w.mu.Unlock()
+			return 0, err
+		case w.closing || isClosedChan(c.pipe.localDone):
+			w.mu.Unlock()
+			return 0, c.writeErr(io.ErrClosedPipe)
+		case isClosedChan(c.pipe.writeDeadline.wait()):
+			w.mu.Unlock()
+			return 0, c.writeErr(ErrDeadlineExceeded)
+		case len(b) == 0:
+			w.mu.Unlock()
+			return 0, nil
+		}
+		if len(w.held) < w.size || w.noDelay {
+			break
+		}
+		if w.changed == nil {
+			w.changed = make(chan struct{})
+		}
+		changed := w.changed
+		w.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-c.pipe.localDone:
+		case <-c.pipe.writeDeadline.wait():
+		}
+		w.mu.Lock()
+	}
+
+	if (w.noDelay || !w.unacked) && !w.sending && len(w.held) == 0 {
+		// Writes made while b is sent are held so they cannot be sent
+		// before b.
+		w.sending, w.direct = true, true
+		w.mu.Unlock()
+
+		var (
+			n   int
+			err error
+		)
+		if c.laddr.Buffered() {
+			n, err = c.writeAsync(b, false)
+		} else {
+			n, err = c.writeSync(b)
+		}
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.sending, w.direct = false, false
+		if err == nil && !w.noDelay {
+			c.sentLocked()
+		}
+		c.sendHeldLocked()
+		w.idleLocked()
+		w.notify()
+		return n, err
+	}
+
+	w.held = append(w.held, b...)
+	c.sendHeldLocked()
+	w.mu.Unlock()
+	return len(b), nil
+}
+
+// sentLocked marks the data as unacknowledged until the delay passes.
+// The timer that acknowledges the data sent earlier, if any, is replaced.
+// The caller must hold the coalescer's lock.
+func (c *Conn) sentLocked() {
+	w := &c.coalesce
+	if w.ack != nil {
+		w.ack.Stop()
+		w.ack = nil
+	}
+	if w.closing {
+		return
+	}
+	w.unacked = true
+	w.gen++
+	gen := w.gen
+	w.ack = c.clock.AfterFunc(w.delay, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.gen != gen {
+			return
+		}
+		w.unacked = false
+		w.ack = nil
+		c.sendHeldLocked()
+	})
+}
+
+// sendHeldLocked starts the goroutine that sends the held data if the
+// data may be sent and the goroutine is not already running. The caller
+// must hold the coalescer's lock.
+func (c *Conn) sendHeldLocked() {
+	w := &c.coalesce
+	if !w.sending && w.canSendLocked() {
+		w.sending = true
+		go c.sendHeld()
+	}
+}
+
+// canSendLocked returns a flag indicating whether or not the held data
+// may be sent. The caller must hold the coalescer's lock.
+func (w *coalescer) canSendLocked() bool {
+	return len(w.held) > 0 &&
+		(w.force || w.noDelay || !w.unacked || len(w.held) >= w.size)
+}
+
+// sendHeld sends the held data until it may no longer be sent. It is run
+// as a goroutine. The held data is not subject to the write deadline of
+// the Write operations that held it.
+func (c *Conn) sendHeld() {
+	w := &c.coalesce
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.canSendLocked() {
+		b := w.held
+		w.held = nil
+		w.notify()
+		w.mu.Unlock()
+
+		var err error
+		if c.laddr.Buffered() {
+			_, err = c.writeAsyncWith(b, &noDeadline, true)
+		} else {
+			_, err = c.writeWith(b, &noDeadline, true)
+		}
+
+		w.mu.Lock()
+		if err != nil {
+			w.err = err
+			w.held = nil
+			break
+		}
+		if !w.noDelay {
+			c.sentLocked()
+		}
+		w.notify()
+	}
+	if len(w.held) == 0 {
+		w.force = false
+	}
+	w.sending = false
+	w.idleLocked()
+	w.notify()
+}
+
+// flushHeld sends the held data without waiting for the data sent
+// earlier to be acknowledged.
+func (c *Conn) flushHeld() {
+	w := &c.coalesce
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.held) > 0 {
+		w.force = true
+		c.sendHeldLocked()
+	}
+}
+
+// closeHeld fails the pending and subsequent Write operations, sends the
+// held data without waiting for the data sent earlier to be acknowledged,
+// and waits until the held data is sent or either of the done channels
+// is closed. If a Write operation is sending its data directly then
+// closeHeld does not wait for it, since closing the connection must
+// unblock the Write, and the held data is discarded once the Write fails.
+// A flag is returned indicating whether or not the held data was sent.
+func (c *Conn) closeHeld(done, done2 <-chan struct{}) bool {
+	w := &c.coalesce
+	w.mu.Lock()
+	w.closing = true
+	direct := w.direct
+	if !direct && len(w.held) > 0 {
+		w.force = true
+		c.sendHeldLocked()
+	}
+	w.notify()
+	w.mu.Unlock()
+	if direct {
+		return false
+	}
+	return c.waitForHeld(done, done2)
+}
+
+// stopAck stops the timer that acknowledges the data sent last so the
+// timer does not retain the closed connection.
+func (c *Conn) stopAck() {
+	w := &c.coalesce
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closing = true
+	if w.ack != nil {
+		w.ack.Stop()
+		w.ack = nil
+	}
+}
+
+// waitForHeld blocks until there is no held data or either of the done
+// channels is closed. A nil channel is never closed. A flag is returned
+// indicating whether or not the held data was sent.
+func (c *Conn) waitForHeld(done, done2 <-chan struct{}) bool {
+	w := &c.coalesce
+	for {
+		w.mu.Lock()
+		if len(w.held) == 0 && !w.sending {
+			w.mu.Unlock()
+			return true
+		}
+		if w.changed == nil {
+			w.changed = make(chan struct{})
+		}
+		changed := w.changed
+		w.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-done:
+			return false
+		case <-done2:
+			return false
+		}
+	}
+}
+
+// flushCoalesced sends the held data immediately and waits for it to be
+// sent. The error that occurred while sending held data, if any, is
+// returned. If the context is done first then the context's error is
+// returned.
+func (c *Conn) flushCoalesced(ctx context.Context) error {
+	c.flushHeld()
+	if !c.waitForHeld(ctx.Done(), nil) {
+		return ctx.Err()
+	}
+	c.coalesce.mu.Lock()
+	defer c.coalesce.mu.Unlock()
+	return c.coalesce.err
+}
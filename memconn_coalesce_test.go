@@ -0,0 +1,296 @@
+package memconn_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/akutz/memconn"
+	"github.com/akutz/memconn/memconntest"
+)
+
+func TestCoalesceConnMemb(t *testing.T) {
+	memconntest.TestConn(t, makeCoalescedPipe("memb"))
+}
+
+func TestCoalesceConnMemu(t *testing.T) {
+	memconntest.TestConn(t, makeCoalescedPipe("memu"))
+}
+
+func makeCoalescedPipe(network string) memconntest.MakePipe {
+	return func() (c1, c2 net.Conn, stop func(), err error) {
+		p := &memconn.Provider{}
+		lis, err := p.ListenMem(network, nil)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		defer lis.Close()
+		client, err := p.DialMem(network, nil, nil)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		server, err := lis.AcceptMemConn()
+		if err != nil {
+			client.Close()
+			return nil, nil, nil, err
+		}
+		for _, c := range []*memconn.Conn{client, server} {
+			c.SetBufferSize(4096)
+			c.SetCloseTimeout(time.Second)
+			c.SetCoalescing(time.Millisecond, 512)
+		}
+		return client, server, func() { p.Close() }, nil
+	}
+}
+
+// readAsync reads once from c in a goroutine and returns a channel that
+// receives the data that was read.
+func readAsync(t *testing.T, c *memconn.Conn) <-chan string {
+	ch := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 64)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- string(buf[:n])
+	}()
+	return ch
+}
+
+// expectHeld fails the test if data is read from ch before the held data
+// should be sent.
+func expectHeld(t *testing.T, ch <-chan string) {
+	t.Helper()
+	select {
+	case s := <-ch:
+		t.Fatalf("data was not held: %q", s)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func newCoalescePair(
+	t *testing.T, network string) (*memconn.Conn, *memconn.Conn, *fakeClock) {
+
+	t.Helper()
+	p := &memconn.Provider{}
+	t.Cleanup(func() { p.Close() })
+	clock := newFakeClock()
+	p.SetClock(clock)
+	lis, err := p.ListenMem(network, &memconn.Addr{Name: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := dialPartitionPair(t, p, network, lis, "a")
+	c1.SetCoalescing(time.Second, 8)
+	return c1, c2, clock
+}
+
+func TestCoalesce(t *testing.T) {
+	for _, network := range []string{"memb", "memu"} {
+		t.Run(network, func(t *testing.T) {
+			c1, c2, clock := newCoalescePair(t, network)
+
+			// The first write is sent immediately.
+			ch := readAsync(t, c2)
+			if _, err := c1.Write([]byte("a")); err != nil {
+				t.Fatal(err)
+			}
+			if s := <-ch; s != "a" {
+				t.Fatalf("unexpected data: %q", s)
+			}
+
+			// Writes made before the first write is acknowledged are
+			// held and sent together.
+			ch = readAsync(t, c2)
+			for _, s := range []string{"b", "c"} {
+				if _, err := c1.Write([]byte(s)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expectHeld(t, ch)
+			clock.Advance(time.Second)
+			if s := <-ch; s != "bc" {
+				t.Fatalf("unexpected data: %q", s)
+			}
+
+			// Held data is sent once it reaches the size threshold.
+			ch = readAsync(t, c2)
+			for _, s := range []string{"defg", "hijk"} {
+				if _, err := c1.Write([]byte(s)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if s := <-ch; s != "defghijk" {
+				t.Fatalf("unexpected data: %q", s)
+			}
+		})
+	}
+}
+
+func TestCoalesceFlush(t *testing.T) {
+	c1, c2, _ := newCoalescePair(t, "memb")
+	ch := readAsync(t, c2)
+	c1.Write([]byte("a"))
+	<-ch
+
+	ch = readAsync(t, c2)
+	c1.Write([]byte("b"))
+	expectHeld(t, ch)
+	if err := c1.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-ch; s != "b" {
+		t.Fatalf("unexpected data: %q", s)
+	}
+}
+
+func TestCoalesceNoDelay(t *testing.T) {
+	c1, c2, _ := newCoalescePair(t, "memu")
+	ch := readAsync(t, c2)
+	c1.Write([]byte("a"))
+	<-ch
+
+	ch = readAsync(t, c2)
+	c1.Write([]byte("b"))
+	expectHeld(t, ch)
+
+	// Disabling coalescing sends the held data, and later writes are
+	// sent after it.
+	c1.SetNoDelay(true)
+	if s := <-ch; s != "b" {
+		t.Fatalf("unexpected data: %q", s)
+	}
+	ch = readAsync(t, c2)
+	if _, err := c1.Write([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-ch; s != "c" {
+		t.Fatalf("unexpected data: %q", s)
+	}
+}
+
+func TestCoalesceClose(t *testing.T) {
+	c1, c2, _ := newCoalescePair(t, "memb")
+	c1.SetCloseTimeout(time.Hour)
+	ch := readAsync(t, c2)
+	c1.Write([]byte("a"))
+	<-ch
+	c1.Write([]byte("b"))
+
+	// Close sends the held data of a buffered connection.
+	ch = readAsync(t, c2)
+	go c1.Close()
+	if s := <-ch; s != "b" {
+		t.Fatalf("unexpected data: %q", s)
+	}
+}
+
+func TestCoalesceClosePendingWrite(t *testing.T) {
+	c1, _, _ := newCoalescePair(t, "memu")
+
+	// The write is sent immediately and blocks since nothing reads it.
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c1.Write([]byte("a"))
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// Close does not wait for the pending write and unblocks it.
+	closed := make(chan struct{})
+	go func() {
+		c1.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close blocked on a pending Write")
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Write was not unblocked by Close")
+	}
+}
+
+// TestCoalesceCloseConcurrent validates that both sides of an unbuffered
+// connection may be closed at the same time while they hold data.
+func TestCoalesceCloseConcurrent(t *testing.T) {
+	c1, c2, clock := newCoalescePair(t, "memu")
+	c2.SetCoalescing(time.Second, 8)
+
+	// Send data in both directions so the next writes are held.
+	ch := readAsync(t, c2)
+	c1.Write([]byte("a"))
+	<-ch
+	ch = readAsync(t, c1)
+	c2.Write([]byte("a"))
+	<-ch
+	c1.Write([]byte("b"))
+	c2.Write([]byte("b"))
+
+	closed := make(chan struct{}, 2)
+	for _, c := range []*memconn.Conn{c1, c2} {
+		go func(c *memconn.Conn) {
+			c.Close()
+			closed <- struct{}{}
+		}(c)
+	}
+
+	// Each side waits for its peer to read the held data for at most
+	// the coalescing delay.
+	clock.waitForTimers(4)
+	clock.Advance(time.Second)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-closed:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Close blocked on held data")
+		}
+	}
+}
+
+// TestCoalesceSetCoalescing validates that lowering the size threshold
+// sends the held data that exceeds it.
+func TestCoalesceSetCoalescing(t *testing.T) {
+	c1, c2, _ := newCoalescePair(t, "memb")
+	ch := readAsync(t, c2)
+	c1.Write([]byte("a"))
+	<-ch
+
+	ch = readAsync(t, c2)
+	c1.Write([]byte("bc"))
+	expectHeld(t, ch)
+	c1.SetCoalescing(time.Second, 2)
+	select {
+	case s := <-ch:
+		if s != "bc" {
+			t.Fatalf("unexpected data: %q", s)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("held data was not sent")
+	}
+}
+
+// TestCoalesceCloseStopsAck validates that closing a connection stops
+// the timer that acknowledges the data it sent last.
+func TestCoalesceCloseStopsAck(t *testing.T) {
+	c1, c2, clock := newCoalescePair(t, "memu")
+	ch := readAsync(t, c2)
+	c1.Write([]byte("a"))
+	<-ch
+	if n := clock.pending(); n != 1 {
+		t.Fatalf("unexpected pending timers: %d", n)
+	}
+	c1.Close()
+	if n := clock.pending(); n != 0 {
+		t.Fatalf("timers pending after close: %d", n)
+	}
+}
@@ -1,10 +1,12 @@
 package memconn
 
 import (
-	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -18,6 +20,32 @@ type Conn struct {
 	// buf contains information about the connection's buffer state if
 	// the connection is buffered. Otherwise this field is nil.
 	buf *bufConn
+
+	// lis is the listener from which the connection was accepted. This
+	// field is nil for dialed connections.
+	lis *Listener
+
+	// clock is used to schedule the close timeout
+	clock Clock
+
+	// prov is the Provider that tracks the connection
+	prov *Provider
+
+	// peerMD is the metadata attached by the remote side of the
+	// connection when it was dialed
+	peerMD interface{}
+
+	// link is shared by both sides of the connection and is used to
+	// emulate network failures
+	link *link
+
+	// seg splits the data read from the connection into segments.
+	// Please see the SetSegmentation function for more information.
+	seg segmenter
+
+	// coalesce coalesces small writes to the connection. Please see
+	// the SetNoDelay function for more information.
+	coalesce coalescer
 }
 
 type bufConn struct {
@@ -39,19 +67,74 @@ type bufConn struct {
 	// used to report erros that occur as a result of buffered write
 	// operations. If the pipe does not use buffered writes then this
 	// field will always be nil.
+	//
+	// The channel has a capacity of one and is never blocked on. Since
+	// no more writes are attempted after an asynchronous write fails,
+	// at most one error is ever sent to the channel.
 	errs chan error
 
-	// data is a circular buffer used to provide buffered writes
-	data bytes.Buffer
+	// err is the first error that occurred as the result of an
+	// asynchronous write. Once set, err is returned by subsequent
+	// calls to Write and Close.
+	err error
+
+	// data is a FIFO queue of the payloads pending asynchronous writes.
+	// A payload is not removed from the queue until it has been written
+	// to the underlying connection. The pending payloads are
+	// data[head:]. The queue is reset, and its backing array reused,
+	// once it is empty.
+	data [][]byte
+	head int
+
+	// dataLen is the total number of bytes queued in data
+	dataLen int
+
+	// flushing indicates whether or not the goroutine that writes the
+	// queued payloads to the underlying connection is running
+	flushing bool
 
-	// dataN is a FIFO list of the n bytes written to data
-	dataN []int
+	// dataChanged is closed once a payload is removed from data and
+	// no more than wakeLen bytes remain queued. Goroutines waiting for
+	// room in the queue, or for the queue to be empty, wait on this
+	// channel instead of spinning. The channel is only allocated when a
+	// goroutine needs to wait on it.
+	dataChanged chan struct{}
+	wakeLen     int
 
-	// dataMu guards access to data and dataN
+	// dataMu guards access to data, head, dataLen, flushing,
+	// dataChanged, wakeLen, and err
 	dataMu sync.Mutex
 }
 
-func makeNewConns(network string, laddr, raddr Addr) (*Conn, *Conn) {
+// notify wakes up the goroutines waiting on dataChanged if no more than
+// wakeLen bytes are queued. The caller must hold dataMu.
+func (b *bufConn) notify() {
+	if b.dataChanged != nil && b.dataLen <= b.wakeLen {
+		close(b.dataChanged)
+		b.dataChanged = nil
+	}
+}
+
+// changed returns a channel that is closed once no more than n bytes
+// are queued. The channel may also be closed sooner, on behalf of
+// another waiter, so the caller must check the queue again. The caller
+// must hold dataMu.
+func (b *bufConn) changed(n int) <-chan struct{} {
+	if n < 0 {
+		n = 0
+	}
+	if b.dataChanged == nil {
+		b.dataChanged = make(chan struct{})
+		b.wakeLen = n
+	} else if n > b.wakeLen {
+		b.wakeLen = n
+	}
+	return b.dataChanged
+}
+
+func makeNewConns(
+	network string, laddr, raddr Addr, clock Clock) (*Conn, *Conn) {
+
 	// This code is duplicated from the Pipe() function from the file
 	// "memconn_pipe.go". The reason for the duplication is to optimize
 	// the performance by removing the need to wrap the *pipe values as
@@ -63,6 +146,8 @@ func makeNewConns(network string, laddr, raddr Addr) (*Conn, *Conn) {
 	cn2 := make(chan int)
 	done1 := make(chan struct{})
 	done2 := make(chan struct{})
+	rb1 := newRcvBuf()
+	rb2 := newRcvBuf()
 
 	// Wrap the pipes with Conn to support:
 	//
@@ -74,39 +159,47 @@ func makeNewConns(network string, laddr, raddr Addr) (*Conn, *Conn) {
 	//   * A channel can be setup to cause the event of the Listener
 	//     closing closes the remoteConn immediately.
 	//   * Buffered writes
+	//   * Receive-side buffering
 	local := &Conn{
 		pipe: pipe{
 			rdRx: cb1, rdTx: cn1,
 			wrTx: cb2, wrRx: cn2,
 			localDone: done1, remoteDone: done2,
-			readDeadline:  makePipeDeadline(),
-			writeDeadline: makePipeDeadline(),
+			rbuf: rb1, wbuf: rb2,
+			readDeadline:  makePipeDeadline(clock),
+			writeDeadline: makePipeDeadline(clock),
 		},
 		laddr: laddr,
 		raddr: raddr,
+		clock: clock,
 	}
 	remote := &Conn{
 		pipe: pipe{
 			rdRx: cb2, rdTx: cn2,
 			wrTx: cb1, wrRx: cn1,
 			localDone: done2, remoteDone: done1,
-			readDeadline:  makePipeDeadline(),
-			writeDeadline: makePipeDeadline(),
+			rbuf: rb2, wbuf: rb1,
+			readDeadline:  makePipeDeadline(clock),
+			writeDeadline: makePipeDeadline(clock),
 		},
 		laddr: raddr,
 		raddr: laddr,
+		clock: clock,
 	}
 
+	lnk := &link{conns: [2]*Conn{local, remote}, clock: clock}
+	local.link, remote.link = lnk, lnk
+
 	if laddr.Buffered() {
 		local.buf = &bufConn{
-			errs:         make(chan error),
+			errs:         make(chan error, 1),
 			closeTimeout: 0 * time.Second,
 		}
 	}
 
 	if raddr.Buffered() {
 		remote.buf = &bufConn{
-			errs:         make(chan error),
+			errs:         make(chan error, 1),
 			closeTimeout: 3 * time.Second,
 		}
 	}
@@ -162,6 +255,50 @@ func (c *Conn) SetBufferSize(i int) {
 	}
 }
 
+// SetReadBuffer sets the size of the connection's receive buffer. Data
+// written by the remote side of the connection is copied into the
+// receive buffer until it is full, at which point remote Write
+// operations block until the buffer is drained by local Read
+// operations. This emulates the receive window of a TCP connection.
+//
+// When the remote side of the connection is buffered, a slow reader
+// stalls the remote side once the combined window, the remote side's
+// buffer size plus this connection's receive buffer size, is full.
+//
+// The default size is zero, which means there is no receive buffer
+// and remote Write operations are matched directly with local Read
+// operations.
+func (c *Conn) SetReadBuffer(bytes int) error {
+	if bytes < 0 {
+		return c.setBufferErr()
+	}
+	c.pipe.rbuf.setMax(bytes)
+	return nil
+}
+
+// SetWriteBuffer sets the number of bytes allowed to be queued for
+// asynchronous Write operations. It is equivalent to SetBufferSize.
+//
+// Please note that setting the write buffer has no effect on unbuffered
+// connections.
+func (c *Conn) SetWriteBuffer(bytes int) error {
+	if bytes < 0 {
+		return c.setBufferErr()
+	}
+	c.SetBufferSize(bytes)
+	return nil
+}
+
+func (c *Conn) setBufferErr() error {
+	return &net.OpError{
+		Op:     "set",
+		Addr:   c.raddr,
+		Source: c.laddr,
+		Net:    c.laddr.Network(),
+		Err:    syscall.EINVAL,
+	}
+}
+
 // CloseTimeout gets the time.Duration value used when closing buffered
 // connections.
 //
@@ -206,206 +343,651 @@ func (c *Conn) RemoteAddr() net.Addr {
 }
 
 // Close implements the net.Conn Close method.
+//
+// If the connection is buffered then Close returns the first error
+// that occurred as the result of an asynchronous write, if any.
 func (c *Conn) Close() error {
+	c.close(false)
+	if c.laddr.Buffered() {
+		return c.asyncErr()
+	}
+	return nil
+}
+
+// closeNow closes the connection without waiting for pending, buffered
+// Writes to complete.
+func (c *Conn) closeNow() {
+	c.close(true)
+}
+
+func (c *Conn) close(force bool) {
 	c.pipe.once.Do(func() {
 
 		// Buffered connections will attempt to wait until all
 		// pending Writes are completed or until the specified
 		// timeout value has elapsed.
-		if c.laddr.Buffered() {
-
-			// Set up a channel that is closed when the specified
-			// timer elapses.
-			timeout := c.CloseTimeout()
-			timeoutDone := make(chan struct{})
-			if timeout == 0 {
-				close(timeoutDone)
-			} else {
-				time.AfterFunc(timeout, func() { close(timeoutDone) })
-			}
+		if c.laddr.Buffered() && !force {
 
-			// Set up a channel that is closed when there is
-			// no more buffered data.
-			writesDone := make(chan struct{})
-			go func() {
-				c.buf.dataMu.Lock()
-				defer c.buf.dataMu.Unlock()
-				for len(c.buf.dataN) > 0 {
-					c.buf.dataMu.Unlock()
-					c.buf.dataMu.Lock()
-				}
-				close(writesDone)
-			}()
-
-			// Wait to close the connection.
-			select {
-			case <-writesDone:
-			case <-timeoutDone:
+			// Wait until there is no more buffered data, including
+			// the data held to coalesce writes, or the specified
+			// timeout value has elapsed.
+			if timeout := c.CloseTimeout(); timeout > 0 {
+				timeoutDone := make(chan struct{})
+				timer := c.clock.AfterFunc(
+					timeout, func() { close(timeoutDone) })
+				c.closeHeld(timeoutDone, nil)
+				c.waitForWrites(timeoutDone)
+				timer.Stop()
 			}
+		} else if !force && c.coalesce.isEnabled() {
+
+			// Unbuffered connections send the data held to coalesce
+			// writes and wait until it is read, like a Write
+			// operation, unless the remote side is closed or the
+			// coalescing delay passes first. The delay bounds the
+			// wait when both sides close at the same time. Pending
+			// Write operations are not waited for.
+			c.coalesce.mu.Lock()
+			delay := c.coalesce.delay
+			c.coalesce.mu.Unlock()
+			delayDone := make(chan struct{})
+			timer := c.clock.AfterFunc(
+				delay, func() { close(delayDone) })
+			c.closeHeld(c.pipe.remoteDone, delayDone)
+			timer.Stop()
 		}
 
 		close(c.pipe.localDone)
+		c.link.connClosed()
+		c.stopAck()
+
+		// Inform the listener from which this connection was accepted
+		// and the Provider that tracks this connection that the
+		// connection is closed.
+		if c.lis != nil {
+			c.lis.untrack(c)
+		}
+		if c.prov != nil {
+			c.prov.untrack(c)
+		}
 	})
-	return nil
 }
 
-// Errs returns a channel that receives errors that may occur as the
-// result of buffered write operations.
+// Errs returns a channel that receives the first error that occurs as
+// the result of a buffered write operation. Reading from the channel is
+// optional; the same error is also returned by the next call to Write
+// or Close.
 //
 // This function will always return nil for unbuffered connections.
 //
-// Please note that the channel returned by this function is not closed
-// when the connection is closed. This is because errors may continue
-// to be sent over this channel as the result of asynchronous writes
-// occurring after the connection is closed. Therefore this channel
-// should not be used to determine when the connection is closed.
+// Please note that the channel returned by this function is never
+// closed and receives at most one error. Therefore this channel should
+// not be used to determine when the connection is closed.
 func (c *Conn) Errs() <-chan error {
+	if c.buf == nil {
+		return nil
+	}
 	return c.buf.errs
 }
 
+// Flush blocks until all of the data queued by buffered Write operations
+// has been written to the remote side of the connection or the provided
+// context is done. The first error that occurred as the result of an
+// asynchronous write, if any, is returned. If the context is done first
+// then the context's error is returned.
+//
+// If the connection coalesces writes then the held data is sent without
+// delay before waiting for the queued data. Please see the SetNoDelay
+// function for more information.
+//
+// Otherwise this function always returns nil immediately for unbuffered
+// connections since their Write operations are synchronous.
+func (c *Conn) Flush(ctx context.Context) error {
+	if err := c.flushCoalesced(ctx); err != nil {
+		return err
+	}
+	if !c.laddr.Buffered() {
+		return nil
+	}
+	if !c.waitForWrites(ctx.Done()) {
+		return ctx.Err()
+	}
+	return c.asyncErr()
+}
+
+// asyncErr returns the first error that occurred as the result of an
+// asynchronous write.
+func (c *Conn) asyncErr() error {
+	c.buf.dataMu.Lock()
+	defer c.buf.dataMu.Unlock()
+	return c.buf.err
+}
+
 // Read implements the net.Conn Read method.
 func (c *Conn) Read(b []byte) (int, error) {
-	n, err := c.pipe.Read(b)
+	if err := c.link.wait(c.pipe.localDone, &c.pipe.readDeadline); err != nil {
+		return 0, c.readErr(err)
+	}
+	var (
+		n   int
+		err error
+	)
+	if c.seg.isEnabled() {
+		n, err = c.readSegment(b)
+	} else {
+		n, err = c.pipe.Read(b)
+	}
 	if err != nil {
-		if e, ok := err.(*net.OpError); ok {
-			e.Addr = c.raddr
-			e.Source = c.laddr
-			return n, e
-		}
-		return n, &net.OpError{
-			Op:     "read",
-			Addr:   c.raddr,
-			Source: c.laddr,
-			Net:    c.raddr.Network(),
-			Err:    err,
-		}
+		return n, c.readErr(err)
 	}
 	return n, nil
 }
 
+// readErr wraps err as a *net.OpError with the connection's address
+// information. Like other net.Conn implementations, io.EOF is returned
+// as-is.
+func (c *Conn) readErr(err error) error {
+	if err == io.EOF && !c.link.isReset() {
+		return err
+	}
+	return c.opErr("read", err)
+}
+
+// opErr wraps err as a *net.OpError with the connection's address
+// information. If err is already a *net.OpError returned by the
+// underlying pipe then the error it wraps is used instead. The error
+// returned by the pipe when the connection is closed is replaced with
+// ErrClosed, or with ErrConnReset if the connection was reset.
+func (c *Conn) opErr(op string, err error) error {
+	if e, ok := err.(*net.OpError); ok {
+		err = e.Err
+	}
+	switch {
+	case (err == io.ErrClosedPipe || err == io.EOF) && c.link.isReset():
+		err = ErrConnReset
+	case err == io.ErrClosedPipe && isClosedChan(c.pipe.localDone):
+		err = ErrClosed
+	}
+	return &net.OpError{
+		Op:     op,
+		Addr:   c.raddr,
+		Source: c.laddr,
+		Net:    c.raddr.Network(),
+		Err:    err,
+	}
+}
+
 // Write implements the net.Conn Write method.
 func (c *Conn) Write(b []byte) (int, error) {
+	if c.coalesce.isEnabled() {
+		return c.writeCoalesced(b)
+	}
 	if c.laddr.Buffered() {
-		return c.writeAsync(b)
+		return c.writeAsync(b, false)
 	}
 	return c.writeSync(b)
 }
 
-func (c *Conn) writeSync(b []byte) (int, error) {
-	n, err := c.pipe.Write(b)
-	if err != nil {
-		if e, ok := err.(*net.OpError); ok {
-			e.Addr = c.raddr
-			e.Source = c.laddr
-			return n, e
+// WriteBuffers writes the contents of v to the connection as a single
+// unit, so the data cannot be interleaved with concurrent Write
+// operations. Buffered connections queue the contents of v as a single
+// payload. Like net.Buffers.WriteTo, the slices written are consumed
+// from v.
+//
+// Please note that net.Buffers.WriteTo detects vectored writers using
+// an unexported interface that types outside of the Go standard library
+// cannot implement. Therefore callers should use WriteBuffers directly
+// rather than net.Buffers.WriteTo when writing to a *Conn.
+func (c *Conn) WriteBuffers(v *net.Buffers) (int64, error) {
+	var n int64
+	if coalesce := c.coalesce.isEnabled(); coalesce || c.laddr.Buffered() {
+		var size int
+		for _, b := range *v {
+			size += len(b)
 		}
-		return n, &net.OpError{
-			Op:     "write",
-			Addr:   c.raddr,
-			Source: c.laddr,
-			Net:    c.raddr.Network(),
-			Err:    err,
+		p := make([]byte, 0, size)
+		for _, b := range *v {
+			p = append(p, b...)
 		}
+		var (
+			nw  int
+			err error
+		)
+		if coalesce {
+			nw, err = c.writeCoalesced(p)
+		} else {
+			nw, err = c.writeAsync(p, true)
+		}
+		n = int64(nw)
+		consumeBuffers(v, n)
+		return n, err
+	}
+
+	err := c.link.wait(c.pipe.localDone, &c.pipe.writeDeadline)
+	if err != nil {
+		return 0, c.writeErr(err)
+	}
+	n, err = c.pipe.writev(*v, &c.pipe.writeDeadline)
+	consumeBuffers(v, n)
+	if err != nil {
+		return n, c.writeErr(err)
 	}
 	return n, nil
 }
 
-// writeAsync performs the Write operation in a goroutine. This
-// behavior means the Write operation is not blocking, but also means
-// that when Write operations fail the associated error is not returned
-// from this function.
-func (c *Conn) writeAsync(b []byte) (int, error) {
+// consumeBuffers removes n bytes from v.
+func consumeBuffers(v *net.Buffers, n int64) {
+	for len(*v) > 0 {
+		ln0 := int64(len((*v)[0]))
+		if ln0 > n {
+			(*v)[0] = (*v)[0][n:]
+			return
+		}
+		n -= ln0
+		(*v)[0] = nil
+		*v = (*v)[1:]
+	}
+}
+
+// copyBufferSize is the size of the buffer used by ReadFrom and WriteTo.
+// It is the same size used by io.Copy.
+const copyBufferSize = 32 * 1024
+
+// ReadFrom implements the io.ReaderFrom ReadFrom method.
+//
+// If r is a *Conn then the data is transferred using r's WriteTo method.
+// Otherwise data is read from r directly into buffers that are handed
+// to the connection without being copied again.
+//
+// The connection's write deadline applies to writing the data in both
+// cases. If r is a *Conn then r's read deadline also applies to waiting
+// for the data, so the operation fails once either deadline passes.
+// Otherwise waiting for the data is governed by r alone.
+func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
+	if src, ok := r.(*Conn); ok {
+		return src.WriteTo(c)
+	}
+
+	size := copyBufferSize
+	if l, ok := r.(*io.LimitedReader); ok && int64(size) > l.N {
+		if size = int(l.N); size < 1 {
+			size = 1
+		}
+	}
+
+	var n int64
+	buf := make([]byte, size)
+	for {
+		nr, er := r.Read(buf)
+		if nr > 0 {
+			var (
+				nw int
+				ew error
+			)
+
+			// Hand off buffers that are at least half full to the
+			// connection instead of copying them. Buffers that are less
+			// than half full are copied so they may be reused. A buffer
+			// that was handed off is only replaced if the connection
+			// retained it.
+			if nr >= len(buf)/2 {
+				var retained bool
+				nw, retained, ew = c.writeOwned(buf[:nr])
+				if retained {
+					buf = make([]byte, size)
+				}
+			} else {
+				nw, ew = c.Write(buf[:nr])
+			}
+			n += int64(nw)
+			if ew != nil {
+				return n, ew
+			}
+			if nw != nr {
+				return n, io.ErrShortWrite
+			}
+		}
+		if er == io.EOF {
+			return n, nil
+		}
+		if er != nil {
+			return n, er
+		}
+	}
+}
+
+// WriteTo implements the io.WriterTo WriteTo method.
+//
+// Data in the connection's receive buffer is passed to w without being
+// copied into an intermediate buffer. If w is also a *Conn then that
+// data is handed to w without being copied at all.
+//
+// The connection's read deadline applies to the operation.
+func (c *Conn) WriteTo(w io.Writer) (int64, error) {
+	var (
+		n       int64
+		scratch []byte
+	)
+	dst, _ := w.(*Conn)
+	for {
+		if scratch == nil {
+			scratch = make([]byte, copyBufferSize)
+		}
+		er := c.link.wait(c.pipe.localDone, &c.pipe.readDeadline)
+		if er != nil {
+			return n, c.readErr(er)
+		}
+
+		// Segmented data is copied into scratch one segment at a time,
+		// so the payloads in the receive buffer are not passed to w
+		// whole.
+		var (
+			b     []byte
+			owned bool
+		)
+		if c.seg.isEnabled() {
+			var nr int
+			nr, er = c.readSegment(scratch)
+			b = scratch[:nr]
+		} else {
+			b, owned, er = c.pipe.take(scratch)
+		}
+		if len(b) > 0 {
+			var (
+				nw int
+				ew error
+			)
+			if dst != nil && owned {
+				nw, _, ew = dst.writeOwned(b)
+			} else {
+				nw, ew = w.Write(b)
+			}
+			n += int64(nw)
+			if ew != nil {
+				return n, ew
+			}
+			if nw != len(b) {
+				return n, io.ErrShortWrite
+			}
+		}
+		if er == io.EOF {
+			return n, nil
+		}
+		if er != nil {
+			return n, c.readErr(er)
+		}
+	}
+}
+
+// writeOwned is the same as Write except the caller transfers ownership
+// of b to the connection, so b is not copied if it is retained. The
+// returned flag indicates whether or not b was retained, in which case
+// the caller must no longer modify b. Otherwise the caller may reuse b.
+func (c *Conn) writeOwned(b []byte) (int, bool, error) {
+	if c.coalesce.isEnabled() {
+		n, err := c.writeCoalesced(b)
+		return n, false, err
+	}
+	if c.laddr.Buffered() {
+		return c.writeAsyncRetained(b, &c.pipe.writeDeadline, true)
+	}
+	return c.writeWithRetained(b, &c.pipe.writeDeadline, true)
+}
+
+func (c *Conn) writeSync(b []byte) (int, error) {
+	return c.writeWith(b, &c.pipe.writeDeadline, false)
+}
+
+// writeWith is the same as writeSync except the provided deadline is
+// used instead of the connection's write deadline. If owned is true then
+// the caller transfers ownership of b to the connection.
+func (c *Conn) writeWith(b []byte, d *pipeDeadline, owned bool) (int, error) {
+	n, _, err := c.writeWithRetained(b, d, owned)
+	return n, err
+}
+
+// writeWithRetained is the same as writeWith except it also returns a
+// flag indicating whether or not b was retained by the remote receive
+// buffer.
+func (c *Conn) writeWithRetained(
+	b []byte, d *pipeDeadline, owned bool) (int, bool, error) {
+
+	if err := c.link.wait(c.pipe.localDone, d); err != nil {
+		return 0, false, c.writeErr(err)
+	}
+	n, retained, err := c.pipe.writeWith(b, d, owned)
+	if err != nil {
+		return n, retained, c.writeErr(err)
+	}
+	return n, retained, nil
+}
+
+// writeAsync queues the Write operation to be performed by a goroutine.
+// This behavior means the Write operation is not blocking, but also means
+// that when a Write operation fails the associated error is not returned
+// from this function. Instead the error is returned from the next call
+// to Write or Close, the same way the bufio.Writer type reports errors.
+//
+// If owned is true then the caller transfers ownership of b to the
+// connection and b is queued without being copied.
+func (c *Conn) writeAsync(b []byte, owned bool) (int, error) {
+	return c.writeAsyncWith(b, &c.pipe.writeDeadline, owned)
+}
+
+// writeAsyncWith is the same as writeAsync except the provided deadline
+// is used instead of the connection's write deadline.
+func (c *Conn) writeAsyncWith(
+	b []byte, d *pipeDeadline, owned bool) (int, error) {
+
+	n, _, err := c.writeAsyncRetained(b, d, owned)
+	return n, err
+}
+
+// writeAsyncRetained is the same as writeAsyncWith except it also
+// returns a flag indicating whether or not b was queued, or placed into
+// the remote receive buffer, without being copied.
+func (c *Conn) writeAsyncRetained(
+	b []byte, d *pipeDeadline, owned bool) (int, bool, error) {
+
 	// Prevent concurrent writes.
 	c.buf.writeMu.Lock()
 	defer c.buf.writeMu.Unlock()
 
-	// Get the max buffer size to determine if the buffer's capacity
-	// should be grown.
+	// Do not queue more data once an asynchronous write has failed.
+	if err := c.asyncErr(); err != nil {
+		return 0, false, err
+	}
+
+	// Like unbuffered writes, fail instead of queuing the data if the
+	// connection is closed or the write deadline has passed. Writes to
+	// a connection whose remote side is closed are still queued and
+	// fail asynchronously, like writes to a TCP connection whose peer
+	// is closed.
+	switch {
+	case isClosedChan(c.pipe.localDone):
+		return 0, false, c.writeErr(io.ErrClosedPipe)
+	case isClosedChan(d.wait()):
+		return 0, false, c.writeErr(ErrDeadlineExceeded)
+	}
+
+	// There is nothing to queue for empty writes.
+	if len(b) == 0 {
+		return 0, false, nil
+	}
+
+	// Get the max buffer size to determine if there is room in the
+	// queue for the provided data.
 	c.buf.configMu.RLock()
 	max := c.buf.max
 	c.buf.configMu.RUnlock()
 
 	// If the provided data is too large for the buffer then force
-	// a synchrnous write.
+	// a synchrnous write once the data already queued is written.
 	if max > 0 && len(b) > max {
-		return c.writeSync(b)
+		if err := c.waitForRoom(0, d); err != nil {
+			return 0, false, err
+		}
+		if err := c.asyncErr(); err != nil {
+			return 0, false, err
+		}
+		return c.writeWithRetained(b, d, owned)
+	}
+
+	// Wait until there is room in the buffer to proceed.
+	if err := c.waitForRoom(max-len(b), d); err != nil {
+		return 0, false, err
+	}
+
+	// The payload is copied since the caller is free to reuse b once
+	// this function returns, unless the caller transferred ownership.
+	p := b
+	if !owned {
+		p = make([]byte, len(b))
+		copy(p, b)
 	}
 
-	// Lock access to the buffer. This prevents concurrent writes to
-	// the buffer. Occasionally the lock is released temporarily to
-	// check if the buffer's length allows this write operation to
-	// proceed.
 	c.buf.dataMu.Lock()
+	defer c.buf.dataMu.Unlock()
 
-	// If the max buffer size is non-zero and larger than the
-	// capacity of the buffer, then grow the buffer capacity.
-	if max > 0 && max > c.buf.data.Cap() {
-		c.buf.data.Grow(max)
+	// An asynchronous write may have failed while waiting for room.
+	if c.buf.err != nil {
+		return 0, false, c.buf.err
 	}
 
-	// Wait until there is room in the buffer to proceed.
-	for max > 0 && c.buf.data.Len()+len(b) > c.buf.data.Cap() {
-		c.buf.dataMu.Unlock()
-		c.buf.dataMu.Lock()
+	// Move the pending payloads to the front of the queue instead of
+	// growing it when its backing array is full.
+	if c.buf.head > 0 && len(c.buf.data) == cap(c.buf.data) {
+		n := copy(c.buf.data, c.buf.data[c.buf.head:])
+		for i := n; i < len(c.buf.data); i++ {
+			c.buf.data[i] = nil
+		}
+		c.buf.data = c.buf.data[:n]
+		c.buf.head = 0
 	}
-	defer c.buf.dataMu.Unlock()
+	c.buf.data = append(c.buf.data, p)
+	c.buf.dataLen += len(p)
 
-	// Write the data to the buffer.
-	n, err := c.buf.data.Write(b)
-	if err != nil {
-		return n, err
-	} else if n < len(b) {
-		return n, fmt.Errorf("trunc write: exp=%d act=%d", len(b), n)
-	}
-
-	// Record the number of bytes written in a FIFO list.
-	c.buf.dataN = append(c.buf.dataN, n)
-
-	// Start a goroutine that reads n bytes from the buffer where n
-	// is the first element in the FIFO list from above. The read
-	// below may not actually correspond to the write from above;
-	// that's okay. The important thing is the order of the reads,
-	// and that's achieved using the circular buffer and FIFO list
-	// of bytes written.
-	go func() {
-		// The read operation must also obtain a lock, preventing
-		// concurrent access to the buffer.
+	// Start the goroutine that writes the queued data to the underlying
+	// connection if it is not already running. The goroutine exits once
+	// the queue is empty, so idle connections do not have one.
+	if !c.buf.flushing {
+		c.buf.flushing = true
+		go c.flush()
+	}
+
+	return len(b), owned, nil
+}
+
+// waitForRoom blocks until no more than n bytes are queued for
+// asynchronous writes or the provided deadline passes. The function
+// returns immediately if no maximum buffer size is defined.
+func (c *Conn) waitForRoom(n int, d *pipeDeadline) error {
+	c.buf.configMu.RLock()
+	max := c.buf.max
+	c.buf.configMu.RUnlock()
+
+	for {
 		c.buf.dataMu.Lock()
+		if max == 0 || c.buf.dataLen == 0 || c.buf.dataLen <= n {
+			c.buf.dataMu.Unlock()
+			return nil
+		}
+		changed := c.buf.changed(n)
+		c.buf.dataMu.Unlock()
 
-		// Get the number of bytes to read.
-		n := c.buf.dataN[0]
-		c.buf.dataN = c.buf.dataN[1:]
+		select {
+		case <-changed:
+		case <-c.pipe.localDone:
+			return c.writeErr(io.ErrClosedPipe)
+		case <-c.pipe.remoteDone:
+			return c.writeErr(io.ErrClosedPipe)
+		case <-d.wait():
+			return c.writeErr(ErrDeadlineExceeded)
+		}
+	}
+}
 
-		// Read the bytes from the buffer into a temporary buffer.
-		b := make([]byte, n)
-		if nr, err := c.buf.data.Read(b); err != nil {
-			go func() { c.buf.errs <- err }()
+// waitForWrites blocks until all of the queued, asynchronous writes have
+// been written to the underlying connection or the done channel is
+// closed. A flag is returned indicating whether or not the queue was
+// emptied.
+func (c *Conn) waitForWrites(done <-chan struct{}) bool {
+	for {
+		c.buf.dataMu.Lock()
+		if c.buf.dataLen == 0 {
 			c.buf.dataMu.Unlock()
-			return
-		} else if nr < n {
-			go func() {
-				c.buf.errs <- fmt.Errorf("trunc read: exp=%d act=%d", n, nr)
-			}()
+			return true
+		}
+		changed := c.buf.changed(0)
+		c.buf.dataMu.Unlock()
+
+		select {
+		case <-changed:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// flush writes the queued payloads to the underlying connection in
+// FIFO order. It is run as a goroutine and returns once the queue is
+// empty.
+func (c *Conn) flush() {
+	for {
+		c.buf.dataMu.Lock()
+		if c.buf.head == len(c.buf.data) {
+			c.buf.flushing = false
 			c.buf.dataMu.Unlock()
 			return
 		}
+		b := c.buf.data[c.buf.head]
+		c.buf.dataMu.Unlock()
 
-		// Ensure access to the buffer is restored.
-		defer c.buf.dataMu.Unlock()
+		// Write the payload to the underlying connection. The write
+		// deadline only applies to the Write operation that queued the
+		// payload, not to the payload's delivery.
+		nw, err := c.writeWith(b, &noDeadline, true)
+		if err == nil && nw < len(b) {
+			err = fmt.Errorf("trunc write: exp=%d act=%d", len(b), nw)
+		}
+		// If the write failed then record the error, discard the
+		// remaining payloads, and wake up any goroutines waiting on the
+		// queue to change.
+		if err != nil {
+			c.buf.dataMu.Lock()
+			c.buf.err = err
+			c.buf.data = nil
+			c.buf.head = 0
+			c.buf.dataLen = 0
+			c.buf.flushing = false
+			c.buf.notify()
+			c.buf.dataMu.Unlock()
 
-		// Write the temporary buffer into the underlying connection.
-		if nw, err := c.writeSync(b); err != nil {
-			go func() { c.buf.errs <- err }()
-			return
-		} else if nw < n {
-			go func() {
-				c.buf.errs <- fmt.Errorf("trunc write: exp=%d act=%d", n, nw)
-			}()
+			// The send never blocks since this is the only error ever
+			// sent to the channel and the channel is buffered.
+			c.buf.errs <- err
 			return
 		}
-	}()
 
-	return n, nil
+		// Remove the payload from the queue and wake up any goroutines
+		// waiting on the queue to change.
+		c.buf.dataMu.Lock()
+		c.buf.data[c.buf.head] = nil
+		c.buf.head++
+		if c.buf.head == len(c.buf.data) {
+			c.buf.data = c.buf.data[:0]
+			c.buf.head = 0
+		}
+		c.buf.dataLen -= len(b)
+		c.buf.notify()
+		c.buf.dataMu.Unlock()
+	}
+}
+
+// writeErr wraps err as a *net.OpError with the connection's address
+// information.
+func (c *Conn) writeErr(err error) error {
+	return c.opErr("write", err)
 }
 
 // SetReadDeadline implements the net.Conn SetReadDeadline method.
@@ -0,0 +1,115 @@
+package memconn
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+var (
+	// ErrConnRefused is returned when a dial is refused because there
+	// is no listener at the remote address, the listener is closed or
+	// shutting down, or the listener's admission function refused the
+	// dial. The error matches syscall.ECONNREFUSED using errors.Is.
+	ErrConnRefused error = &memError{
+		msg: "connection refused",
+		err: syscall.ECONNREFUSED,
+	}
+
+	// ErrWrongNetwork is returned when dialing a name that is not
+	// listened on by the dialed network type, but is listened on by a
+	// different network type. The error matches ErrConnRefused and
+	// syscall.ECONNREFUSED using errors.Is.
+	//
+	// Please see the Provider's SetSharedNamespace function for more
+	// information.
+	ErrWrongNetwork error = &memError{
+		msg: "connection refused: remote address is on a different network",
+		err: ErrConnRefused,
+	}
+
+	// ErrAddrInUse is returned when listening on an address that is
+	// already in use. The error matches syscall.EADDRINUSE using
+	// errors.Is.
+	ErrAddrInUse error = &memError{
+		msg: "address already in use",
+		err: syscall.EADDRINUSE,
+	}
+
+	// ErrConnReset is returned by the operations on a connection that
+	// was reset, for example by a Provider's partition. The error
+	// matches syscall.ECONNRESET using errors.Is.
+	ErrConnReset error = &memError{
+		msg: "connection reset by peer",
+		err: syscall.ECONNRESET,
+	}
+
+	// ErrUnreachable is returned when a dial is refused because the
+	// dialer and the listener are on different sides of a Provider's
+	// partition. The error matches syscall.EHOSTUNREACH using
+	// errors.Is.
+	ErrUnreachable error = &memError{
+		msg: "no route to host",
+		err: syscall.EHOSTUNREACH,
+	}
+
+	// ErrClosed is returned when using a closed listener or connection.
+	// The error matches net.ErrClosed using errors.Is. For compatibility
+	// with previous versions of this package the error also matches
+	// io.ErrClosedPipe.
+	ErrClosed error = &memError{
+		msg: "use of closed network connection",
+		err: net.ErrClosed,
+		is:  io.ErrClosedPipe,
+	}
+
+	// ErrDeadlineExceeded is returned when a Read or Write operation
+	// does not complete before the connection's deadline. The error
+	// matches os.ErrDeadlineExceeded using errors.Is and its Timeout
+	// function returns true.
+	ErrDeadlineExceeded error = &memError{
+		msg:     "i/o timeout",
+		err:     os.ErrDeadlineExceeded,
+		timeout: true,
+	}
+)
+
+// memError is the type of the errors exported by this package.
+type memError struct {
+	msg string
+
+	// err is the standard error that this error wraps
+	err error
+
+	// is is an additional error that this error matches
+	is error
+
+	timeout bool
+}
+
+func (e *memError) Error() string   { return e.msg }
+func (e *memError) Unwrap() error   { return e.err }
+func (e *memError) Timeout() bool   { return e.timeout }
+func (e *memError) Temporary() bool { return e.timeout }
+
+func (e *memError) Is(target error) bool {
+	return e.is != nil && target == e.is
+}
+
+// refusedError is returned when a listener's admission function refuses
+// a dial. The error matches ErrConnRefused using errors.Is and unwraps to
+// the error returned by the admission function.
+type refusedError struct {
+	err error
+}
+
+func (e *refusedError) Error() string {
+	return ErrConnRefused.Error() + ": " + e.err.Error()
+}
+
+func (e *refusedError) Unwrap() error { return e.err }
+
+func (e *refusedError) Is(target error) bool {
+	return target == ErrConnRefused || target == syscall.ECONNREFUSED
+}
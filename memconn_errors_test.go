@@ -0,0 +1,142 @@
+package memconn_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/akutz/memconn"
+)
+
+// TestErrors validates that the errors returned by memconn match the
+// Go stdlib errors returned by TCP connections using errors.Is.
+func TestErrors(t *testing.T) {
+	p := &memconn.Provider{}
+	addr := &memconn.Addr{Name: t.Name()}
+
+	assertIs := func(err error, targets ...error) {
+		t.Helper()
+		for _, target := range targets {
+			if !errors.Is(err, target) {
+				t.Fatalf("errors.Is(%[1]T(%[1]v), %[2]v) == false", err, target)
+			}
+		}
+	}
+
+	// Dialing an unknown address is refused.
+	_, err := p.DialMem("memu", nil, addr)
+	assertIs(err, syscall.ECONNREFUSED, memconn.ErrConnRefused)
+
+	lis, err := p.ListenMem("memu", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Listening on an address that is in use fails.
+	_, err = p.ListenMem("memu", addr)
+	assertIs(err, syscall.EADDRINUSE, memconn.ErrAddrInUse)
+
+	// Dials refused by the admission function include the cause.
+	errDenied := errors.New("denied")
+	lis.SetAdmitFunc(func(
+		context.Context, *memconn.Provider, memconn.Addr, interface{}) error {
+		return errDenied
+	})
+	_, err = p.DialMem("memu", nil, addr)
+	assertIs(err, syscall.ECONNREFUSED, memconn.ErrConnRefused, errDenied)
+	lis.SetAdmitFunc(nil)
+
+	client, err := p.DialMem("memu", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := lis.AcceptMemConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Exceeding a deadline is a timeout.
+	client.SetReadDeadline(time.Now())
+	_, err = client.Read(make([]byte, 1))
+	assertIs(err, os.ErrDeadlineExceeded, memconn.ErrDeadlineExceeded)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("err is not a timeout: %v", err)
+	}
+
+	// Reading from a connection whose remote side is closed returns
+	// io.EOF as-is.
+	client.SetReadDeadline(time.Time{})
+	server.Close()
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read err: exp=%v act=%v", io.EOF, err)
+	}
+
+	// Using a closed connection fails.
+	client.Close()
+	_, err = client.Read(make([]byte, 1))
+	assertIs(err, net.ErrClosed, io.ErrClosedPipe, memconn.ErrClosed)
+	_, err = client.Write(fixedData)
+	assertIs(err, net.ErrClosed, memconn.ErrClosed)
+
+	// Accepting from a closed listener fails.
+	lis.Close()
+	_, err = lis.Accept()
+	assertIs(err, net.ErrClosed, memconn.ErrClosed)
+
+	// Dialing a closed listener is refused.
+	_, err = p.DialMem("memu", nil, addr)
+	assertIs(err, syscall.ECONNREFUSED)
+}
+
+// TestNamespaces validates that each network type has its own namespace
+// unless the Provider uses a shared namespace.
+func TestNamespaces(t *testing.T) {
+	p := &memconn.Provider{}
+	for _, network := range []string{"memb", "memu"} {
+		lis, err := p.ListenMem(network, &memconn.Addr{Name: t.Name()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lis.Close()
+	}
+
+	// Only a memb listener is named "membOnly", so dialing it over memu
+	// fails predictably.
+	lis, err := p.ListenMem("memb", &memconn.Addr{Name: "membOnly"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	_, err = p.DialMem("memu", nil, &memconn.Addr{Name: "membOnly"})
+	if !errors.Is(err, memconn.ErrWrongNetwork) ||
+		!errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("dial should have failed with ErrWrongNetwork: %v", err)
+	}
+
+	// When the namespace is shared the name is in use by both networks
+	// and dialing the name connects to the listener's network.
+	p = &memconn.Provider{}
+	p.SetSharedNamespace(true)
+	lis, err = p.ListenMem("memb", &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	_, err = p.ListenMem("memu", &memconn.Addr{Name: t.Name()})
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("listen should have failed with EADDRINUSE: %v", err)
+	}
+	client, err := p.DialMem("memu", nil, &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if network := client.RemoteAddr().Network(); network != "memb" {
+		t.Fatalf("remote network: exp=memb act=%s", network)
+	}
+}
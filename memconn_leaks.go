@@ -0,0 +1,181 @@
+package memconn
+
+import (
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// Leak describes a listener or connection that has not been closed.
+type Leak struct {
+	// Kind is either "listener" or "conn".
+	Kind string
+
+	// LocalAddr is the local address of the listener or connection.
+	LocalAddr net.Addr
+
+	// RemoteAddr is the remote address of the connection. This field
+	// is nil for listeners.
+	RemoteAddr net.Addr
+
+	// Stack is the stack trace of the goroutine that created the
+	// listener or connection. This field is empty if leak tracking was
+	// not enabled when the listener or connection was created.
+	Stack string
+}
+
+// String returns a description of the leak and its stack trace.
+func (l Leak) String() string {
+	var sb strings.Builder
+	if l.RemoteAddr == nil {
+		fmt.Fprintf(&sb, "%s %s:%s",
+			l.Kind, l.LocalAddr.Network(), l.LocalAddr)
+	} else {
+		fmt.Fprintf(&sb, "%s %s:%s->%s",
+			l.Kind, l.LocalAddr.Network(), l.LocalAddr, l.RemoteAddr)
+	}
+	if l.Stack != "" {
+		fmt.Fprintf(&sb, " created at:\n%s", l.Stack)
+	}
+	return sb.String()
+}
+
+// endpoint is a listener or connection tracked by a Provider. Endpoints
+// are stored by value and their addresses are only converted to net.Addr
+// by Leaks, so tracking an endpoint does not allocate.
+type endpoint struct {
+	kind         string
+	laddr, raddr Addr
+
+	// remote indicates whether or not raddr is set, which it is for
+	// connections
+	remote bool
+
+	// stack is the stack trace of the goroutine that created the
+	// endpoint, if leak tracking was enabled
+	stack string
+
+	// seq records the order in which endpoints are created
+	seq uint64
+}
+
+// TestingT is the subset of the testing.TB interface used by
+// VerifyNoLeaks.
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// SetLeakTracking enables or disables recording the stack trace of the
+// goroutine that creates each listener and connection. The stack traces
+// are included in the leaks returned by Leaks and CheckLeaks.
+//
+// Only recording stack traces is opt-in. Every Provider created by the
+// caller always records its open listeners and connections, since the
+// Provider's Close and Partition functions operate on them. Recording
+// them costs a lock and two map operations, but no allocations, per
+// listener or connection, while recording stack traces is expensive and
+// thus disabled by default.
+//
+// The default Provider used by the package-level functions does not
+// record its listeners and connections, so a program that drops a
+// connection without closing it does not retain the connection.
+func (p *Provider) SetLeakTracking(enabled bool) {
+	p.endpoints.Lock()
+	defer p.endpoints.Unlock()
+	p.endpoints.stacks = enabled
+}
+
+// Leaks returns the listeners and connections created by this Provider
+// that have not been closed, in the order in which they were created.
+func (p *Provider) Leaks() []Leak {
+	p.endpoints.Lock()
+	eps := make([]endpoint, 0, len(p.endpoints.cache))
+	for _, ep := range p.endpoints.cache {
+		eps = append(eps, ep)
+	}
+	p.endpoints.Unlock()
+
+	sort.Slice(eps, func(i, j int) bool { return eps[i].seq < eps[j].seq })
+	leaks := make([]Leak, len(eps))
+	for i, ep := range eps {
+		leaks[i] = Leak{
+			Kind:      ep.kind,
+			LocalAddr: ep.laddr,
+			Stack:     ep.stack,
+		}
+		if ep.remote {
+			leaks[i].RemoteAddr = ep.raddr
+		}
+	}
+	return leaks
+}
+
+// CheckLeaks returns an error that lists the listeners and connections
+// created by this Provider that have not been closed. If there are no
+// such listeners or connections then nil is returned.
+func (p *Provider) CheckLeaks() error {
+	leaks := p.Leaks()
+	if len(leaks) == 0 {
+		return nil
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "memconn: %d unclosed endpoint(s)", len(leaks))
+	for _, l := range leaks {
+		fmt.Fprintf(&sb, "\n\n%s", l)
+	}
+	return fmt.Errorf("%s", sb.String())
+}
+
+// VerifyNoLeaks fails the test if any of the listeners or connections
+// created by this Provider have not been closed. This function is
+// intended to be used with testing.TB's Cleanup function:
+//
+//	p := &memconn.Provider{}
+//	p.SetLeakTracking(true)
+//	t.Cleanup(func() { p.VerifyNoLeaks(t) })
+func (p *Provider) VerifyNoLeaks(t TestingT) {
+	t.Helper()
+	if err := p.CheckLeaks(); err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
+// track records that the listener or connection c is open. The raddr
+// argument is nil for listeners. The default Provider does not record
+// its listeners and connections.
+func (p *Provider) track(c interface{}, kind string, laddr Addr, raddr *Addr) {
+	if p == &provider {
+		return
+	}
+	p.endpoints.Lock()
+	defer p.endpoints.Unlock()
+	if p.endpoints.cache == nil {
+		p.endpoints.cache = map[interface{}]endpoint{}
+	}
+	p.endpoints.seq++
+	ep := endpoint{
+		kind:  kind,
+		laddr: laddr,
+		seq:   p.endpoints.seq,
+	}
+	if raddr != nil {
+		ep.raddr, ep.remote = *raddr, true
+	}
+	if p.endpoints.stacks {
+		ep.stack = string(debug.Stack())
+	}
+	p.endpoints.cache[c] = ep
+}
+
+// untrack records that the listener or connection c is closed.
+func (p *Provider) untrack(c interface{}) {
+	if p == &provider {
+		return
+	}
+	p.endpoints.Lock()
+	defer p.endpoints.Unlock()
+	delete(p.endpoints.cache, c)
+}
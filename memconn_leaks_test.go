@@ -0,0 +1,89 @@
+package memconn_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/akutz/memconn"
+)
+
+// TestLeaks validates that unclosed listeners and connections are
+// reported along with the stack traces that created them.
+func TestLeaks(t *testing.T) {
+	p := &memconn.Provider{}
+	p.SetLeakTracking(true)
+
+	lis, err := p.ListenMem("memu", &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := p.DialMem("memu", nil, &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := lis.AcceptMemConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaks := p.Leaks()
+	if len(leaks) != 3 {
+		t.Fatalf("leaks: exp=3 act=%d", len(leaks))
+	}
+	for i, kind := range []string{"listener", "conn", "conn"} {
+		if leaks[i].Kind != kind {
+			t.Fatalf("leaks[%d].Kind: exp=%s act=%s", i, kind, leaks[i].Kind)
+		}
+		if !strings.Contains(leaks[i].Stack, "TestLeaks") {
+			t.Fatalf("leaks[%d].Stack is missing the test:\n%s",
+				i, leaks[i].Stack)
+		}
+	}
+
+	// The test fails if the leaks are verified before the endpoints are
+	// closed.
+	ft := &fakeT{}
+	p.VerifyNoLeaks(ft)
+	if len(ft.errs) != 1 {
+		t.Fatalf("VerifyNoLeaks: exp=1 error act=%d", len(ft.errs))
+	}
+	if !strings.Contains(ft.errs[0], "3 unclosed endpoint(s)") {
+		t.Fatalf("VerifyNoLeaks: %s", ft.errs[0])
+	}
+
+	client.Close()
+	server.Close()
+	lis.Close()
+	if err := p.CheckLeaks(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLeaksPendingConn validates that a connection dialed but never
+// accepted is not reported once its listener is closed.
+func TestLeaksPendingConn(t *testing.T) {
+	p := &memconn.Provider{}
+	t.Cleanup(func() { p.VerifyNoLeaks(t) })
+
+	lis, err := p.ListenMem("memb", &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := p.DialMem("memb", nil, &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis.Close()
+	client.Close()
+}
+
+type fakeT struct {
+	errs []string
+}
+
+func (t *fakeT) Helper() {}
+
+func (t *fakeT) Errorf(format string, args ...interface{}) {
+	t.errs = append(t.errs, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,196 @@
+package memconn
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// link is the state shared by both sides of a connection that is used to
+// emulate network failures. While a link is stalled the connection's
+// Read and Write operations block, while a link is slow the operations
+// are delayed, and once a link is reset the connection's operations fail
+// with ErrConnReset.
+type link struct {
+	// stalled is non-zero while the link is stalled, and delay is the
+	// time in nanoseconds by which operations are delayed. They are
+	// read without holding mu so operations on healthy links remain
+	// cheap.
+	stalled int32
+	delay   int64
+
+	// stallers is the set of owners, such as Providers, that stall the
+	// link, and restored is closed once the set is empty
+	stallers map[interface{}]struct{}
+	restored chan struct{}
+
+	// clock is used to schedule delays
+	clock Clock
+
+	// reset indicates whether or not the link was reset
+	reset bool
+
+	// closed indicates both sides of the connection are closed, after
+	// which the link may no longer be stalled
+	closed bool
+
+	// chaos is the schedule of the faults injected by chaos mode, if
+	// any, which is stopped once either side of the connection is closed
+	chaos *chaosSched
+
+	// conns are both sides of the connection
+	conns [2]*Conn
+
+	// mu guards stallers, restored, reset, closed, and chaos
+	mu sync.Mutex
+}
+
+// stall stalls the link until unstall is called with the same owner. A
+// flag is returned indicating whether or not the link was stalled, which
+// it is not once both sides of the connection are closed.
+func (l *link) stall(owner interface{}) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	if l.stallers == nil {
+		l.stallers = map[interface{}]struct{}{}
+	}
+	if len(l.stallers) == 0 {
+		l.restored = make(chan struct{})
+		atomic.StoreInt32(&l.stalled, 1)
+	}
+	l.stallers[owner] = struct{}{}
+	return true
+}
+
+// unstall restores the link once no owners stall it.
+func (l *link) unstall(owner interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.stallers[owner]; !ok {
+		return
+	}
+	delete(l.stallers, owner)
+	if len(l.stallers) == 0 {
+		atomic.StoreInt32(&l.stalled, 0)
+		close(l.restored)
+	}
+}
+
+// setChaos sets the schedule of the faults injected by chaos mode. A flag
+// is returned indicating whether or not the schedule was set, which it
+// is not once either side of the connection is closed.
+func (l *link) setChaos(cs *chaosSched) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.isClosed() {
+		return false
+	}
+	l.chaos = cs
+	return true
+}
+
+// connClosed is called each time a side of the connection is closed. It
+// stops the faults injected by chaos mode, and once both sides are
+// closed, the link is released by the Providers that stall it so their
+// partitions do not retain the connection.
+func (l *link) connClosed() {
+	l.mu.Lock()
+	cs := l.chaos
+	l.chaos = nil
+	l.mu.Unlock()
+	if cs != nil {
+		cs.stop()
+	}
+
+	if !isClosedChan(l.conns[0].pipe.localDone) ||
+		!isClosedChan(l.conns[1].pipe.localDone) {
+		return
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.closed = true
+	owners := make([]interface{}, 0, len(l.stallers))
+	for owner := range l.stallers {
+		owners = append(owners, owner)
+	}
+	l.mu.Unlock()
+
+	for _, owner := range owners {
+		if p, ok := owner.(*Provider); ok {
+			p.releaseStalled(l)
+		}
+	}
+}
+
+// resetConns resets the link and closes both sides of the connection
+// without waiting for pending, buffered Writes.
+func (l *link) resetConns() {
+	l.mu.Lock()
+	l.reset = true
+	l.mu.Unlock()
+	for _, c := range l.conns {
+		c.closeNow()
+	}
+}
+
+// setDelay sets the time by which the connection's operations are
+// delayed. A zero duration removes the delay.
+func (l *link) setDelay(d time.Duration) {
+	atomic.StoreInt64(&l.delay, int64(d))
+}
+
+// isClosed returns a flag indicating whether or not either side of the
+// connection is closed.
+func (l *link) isClosed() bool {
+	return isClosedChan(l.conns[0].pipe.localDone) ||
+		isClosedChan(l.conns[1].pipe.localDone)
+}
+
+// isReset returns a flag indicating whether or not the link was reset.
+func (l *link) isReset() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.reset
+}
+
+// wait blocks while the link is stalled, and then for the link's delay
+// if the link is slow. An error is returned if the done channel is
+// closed or the deadline passes first.
+func (l *link) wait(done <-chan struct{}, d *pipeDeadline) error {
+	if atomic.LoadInt32(&l.stalled) != 0 {
+		l.mu.Lock()
+		restored := l.restored
+		l.mu.Unlock()
+
+		select {
+		case <-restored:
+		case <-done:
+			return io.ErrClosedPipe
+		case <-d.wait():
+			return ErrDeadlineExceeded
+		}
+	}
+
+	if delay := atomic.LoadInt64(&l.delay); delay > 0 {
+		elapsed := make(chan struct{})
+		timer := l.clock.AfterFunc(
+			time.Duration(delay), func() { close(elapsed) })
+		defer timer.Stop()
+
+		select {
+		case <-elapsed:
+		case <-done:
+			return io.ErrClosedPipe
+		case <-d.wait():
+			return ErrDeadlineExceeded
+		}
+	}
+	return nil
+}
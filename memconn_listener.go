@@ -2,7 +2,6 @@ package memconn
 
 import (
 	"context"
-	"errors"
 	"net"
 	"sync"
 )
@@ -10,44 +9,155 @@ import (
 // Listener implements the net.Listener interface.
 type Listener struct {
 	addr Addr
+	key  listenerKey
+	prov *Provider
 	once sync.Once
 	rcvr chan *Conn
 	done chan struct{}
-	rmvd chan struct{}
+
+	// shut is closed when Shutdown is called. Once closed new dials
+	// are refused.
+	shut     chan struct{}
+	shutOnce sync.Once
+
+	// conns is the set of connections accepted from this listener
+	// that have not yet been closed.
+	conns map[*Conn]struct{}
+
+	// connsIdle is closed when conns becomes empty after Shutdown is
+	// called.
+	connsIdle chan struct{}
+
+	// connsMu guards conns and connsIdle
+	connsMu sync.Mutex
+
+	// admit is the listener's admission function. Please see the
+	// SetAdmitFunc function for more information.
+	admit   AdmitFunc
+	admitMu sync.RWMutex
+}
+
+// AdmitFunc is a function used by a Listener to decide whether or not
+// to admit a dial. The function is called with the dial's context, the
+// Provider used to dial, the dialer's address, and the metadata attached
+// to the dial with WithPeerMetadata, if any.
+//
+// Returning nil admits the dial. Returning an error refuses the dial
+// with a connection refused error. The function may delay the dial by
+// blocking, in which case it should return the context's error if the
+// context is done before the dial is admitted.
+type AdmitFunc func(
+	ctx context.Context, p *Provider, laddr Addr, md interface{}) error
+
+// SetAdmitFunc sets the function used to decide whether or not to admit
+// dials to this listener. The function is called before the dialed
+// connection is announced to the listener, so refused dials are never
+// returned by Accept.
+//
+// Calling SetAdmitFunc(nil) admits all dials, which is the default.
+func (l *Listener) SetAdmitFunc(f AdmitFunc) {
+	l.admitMu.Lock()
+	defer l.admitMu.Unlock()
+	l.admit = f
+}
+
+func (l *Listener) getAdmitFunc() AdmitFunc {
+	l.admitMu.RLock()
+	defer l.admitMu.RUnlock()
+	return l.admit
 }
 
 func (l *Listener) dial(
 	ctx context.Context,
+	p *Provider,
 	network string,
 	laddr, raddr Addr) (*Conn, error) {
 
-	local, remote := makeNewConns(network, laddr, raddr)
-
-	// TODO Figure out if this logic is valid.
-	//
-	// Start a goroutine that closes the remote side of the connection
-	// as soon as the listener's done channel is no longer blocked.
-	//go func() {
-	//	<-l.done
-	//	remoteConn.Close()
-	//}()
+	// Refuse the connection if the listener is shutting down or has
+	// already been closed.
+	if isClosedChan(l.shut) || isClosedChan(l.done) {
+		return nil, &net.OpError{
+			Addr:   raddr,
+			Source: laddr,
+			Net:    network,
+			Op:     "dial",
+			Err:    ErrConnRefused,
+		}
+	}
 
-	// If the provided context is nill then announce a new connection
-	// by placing the new remoteConn onto the rcvr channel. An Accept
-	// call from this listener will remove the remoteConn from the channel.
+	// If the provided context is nil then use a context that is never
+	// done so the admission function and the select statement below
+	// are the same for both cases.
 	if ctx == nil {
-		l.rcvr <- remote
-		return local, nil
+		ctx = context.Background()
+	}
+
+	// Ask the admission function, if any, whether or not to admit the
+	// dial.
+	if admit := l.getAdmitFunc(); admit != nil {
+		if err := admit(ctx, p, laddr, peerMetadata(ctx)); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				err = ctxErr
+			} else {
+				err = &refusedError{err: err}
+			}
+			return nil, &net.OpError{
+				Addr:   raddr,
+				Source: laddr,
+				Net:    network,
+				Op:     "dial",
+				Err:    err,
+			}
+		}
+	}
+
+	local, remote := makeNewConns(network, laddr, raddr, l.prov.getClock())
+
+	// The dialed side of the connection is tracked by the dialing
+	// Provider and the accepted side by the listener's Provider. The
+	// listener is recorded before the connection is announced, since
+	// the connection may be closed concurrently with Accept.
+	local.prov, remote.prov = p, l.prov
+	remote.lis = l
+	local.seg.set(p.getSegmentation())
+	remote.seg.set(l.prov.getSegmentation())
+
+	// Attach the dialer's metadata, if any, to the accepted side of the
+	// connection.
+	remote.peerMD = peerMetadata(ctx)
+	p.track(local, "conn", local.laddr, &local.raddr)
+	l.prov.track(remote, "conn", remote.laddr, &remote.raddr)
+
+	// A partition may have been created since the dial was checked.
+	p.applyPartitions(local)
+	if l.prov != p {
+		l.prov.applyPartitions(remote)
 	}
 
 	// Announce a new connection by placing the new remoteConn
 	// onto the rcvr channel. An Accept call from this listener will
 	// remove the remoteConn from the channel. However, if that does
-	// not occur by the time the context times out / is cancelled, then
-	// an error is returned.
+	// not occur by the time the context times out / is cancelled or
+	// the listener is closed, then an error is returned.
 	select {
 	case l.rcvr <- remote:
+		// The listener may have been closed while the connection was
+		// being announced. If so then drain the rcvr channel to
+		// ensure the connection is not left pending forever.
+		if isClosedChan(l.done) {
+			l.drain()
+		}
 		return local, nil
+	case <-l.done:
+		local.Close()
+		remote.Close()
+		return nil, &net.OpError{
+			Addr:   raddr,
+			Source: laddr,
+			Net:    network,
+			Op:     "dial",
+			Err:    ErrConnRefused,
+		}
 	case <-ctx.Done():
 		local.Close()
 		remote.Close()
@@ -61,6 +171,18 @@ func (l *Listener) dial(
 	}
 }
 
+// drain closes any connections that are pending on the rcvr channel.
+func (l *Listener) drain() {
+	for {
+		select {
+		case c := <-l.rcvr:
+			c.closeNow()
+		default:
+			return
+		}
+	}
+}
+
 // Accept implements the net.Listener Accept method.
 func (l *Listener) Accept() (net.Conn, error) {
 	return l.AcceptMemConn()
@@ -72,33 +194,113 @@ func (l *Listener) AcceptMemConn() (*Conn, error) {
 	select {
 	case remoteConn, ok := <-l.rcvr:
 		if ok {
-			return remoteConn, nil
+			if l.track(remoteConn) {
+				return remoteConn, nil
+			}
+			// The listener is shutting down and is no longer waiting
+			// for connections that were not tracked in time.
+			remoteConn.closeNow()
 		}
 		return nil, &net.OpError{
 			Addr:   l.addr,
 			Source: l.addr,
 			Net:    l.addr.Network(),
-			Err:    errors.New("listener closed"),
+			Err:    ErrClosed,
 		}
 	case <-l.done:
 		return nil, &net.OpError{
 			Addr:   l.addr,
 			Source: l.addr,
 			Net:    l.addr.Network(),
-			Err:    errors.New("listener closed"),
+			Err:    ErrClosed,
 		}
 	}
 }
 
+// track records c as a connection accepted from this listener. A flag is
+// returned indicating whether or not c was recorded, which it is not if
+// Shutdown was called, since Shutdown may have already stopped waiting
+// for the accepted connections.
+func (l *Listener) track(c *Conn) bool {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+	if isClosedChan(l.shut) {
+		return false
+	}
+	if l.conns == nil {
+		l.conns = map[*Conn]struct{}{}
+	}
+	l.conns[c] = struct{}{}
+	return true
+}
+
+// untrack removes c from the listener's accepted connections. It is
+// called when c is closed.
+func (l *Listener) untrack(c *Conn) {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+	delete(l.conns, c)
+	if len(l.conns) == 0 && l.connsIdle != nil && !isClosedChan(l.connsIdle) {
+		close(l.connsIdle)
+	}
+}
+
 // Close implements the net.Listener Close method.
+//
+// Connections that were dialed but not yet accepted are closed.
+// Connections that were already accepted are not affected.
 func (l *Listener) Close() error {
 	l.once.Do(func() {
 		close(l.done)
-		<-l.rmvd
+		l.prov.removeListener(l)
+		l.drain()
 	})
 	return nil
 }
 
+// Shutdown gracefully shuts down the listener. New dials are refused
+// immediately and the listener is closed. Shutdown then waits for all
+// of the connections accepted from the listener to be closed.
+//
+// If the provided context expires before all of the accepted
+// connections have been closed then the remaining connections are
+// forcibly closed and the context's error is returned.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.shutOnce.Do(func() { close(l.shut) })
+	l.Close()
+
+	l.connsMu.Lock()
+	if l.connsIdle == nil {
+		l.connsIdle = make(chan struct{})
+		if len(l.conns) == 0 {
+			close(l.connsIdle)
+		}
+	}
+	idle := l.connsIdle
+	l.connsMu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+	}
+
+	// Forcibly close the remaining connections. The connections are
+	// copied out of the map first because closing a connection
+	// removes it from the map.
+	l.connsMu.Lock()
+	conns := make([]*Conn, 0, len(l.conns))
+	for c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.connsMu.Unlock()
+	for _, c := range conns {
+		c.closeNow()
+	}
+
+	return ctx.Err()
+}
+
 // Addr implements the net.Listener Addr method.
 func (l *Listener) Addr() net.Addr {
 	return l.addr
@@ -0,0 +1,35 @@
+package memconn
+
+import "context"
+
+// peerMetadataKey is the context key for the metadata attached to a dial
+type peerMetadataKey struct{}
+
+// WithPeerMetadata returns a copy of ctx that carries the provided
+// metadata. When the returned context is used to dial a connection, the
+// metadata is attached to the connection accepted by the listener, where
+// it is available from the connection's PeerMetadata function.
+//
+// The metadata may be any value, such as a map or a value describing
+// the identity of the dialer.
+func WithPeerMetadata(ctx context.Context, md interface{}) context.Context {
+	return context.WithValue(ctx, peerMetadataKey{}, md)
+}
+
+// peerMetadata returns the metadata attached to ctx by WithPeerMetadata.
+func peerMetadata(ctx context.Context) interface{} {
+	if ctx == nil {
+		return nil
+	}
+	return ctx.Value(peerMetadataKey{})
+}
+
+// PeerMetadata returns the metadata attached by the remote side of the
+// connection when it was dialed using a context returned by
+// WithPeerMetadata.
+//
+// This function returns nil for connections that were dialed, as
+// opposed to accepted, or if no metadata was attached to the dial.
+func (c *Conn) PeerMetadata() interface{} {
+	return c.peerMD
+}
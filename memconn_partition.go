@@ -0,0 +1,214 @@
+package memconn
+
+import (
+	"context"
+	"path"
+	"sync"
+)
+
+// PartitionMode determines how a Provider's partitions affect the dials
+// and connections that cross them. The zero value refuses dials with
+// ErrUnreachable and stalls connections.
+//
+// Please see the Provider's Partition function for more information.
+type PartitionMode int
+
+const (
+	// PartitionHangDials makes dials that cross a partition block until
+	// the partition is healed or the dial's context is done, instead of
+	// failing immediately with ErrUnreachable.
+	PartitionHangDials PartitionMode = 1 << iota
+
+	// PartitionResetConns resets the existing connections that cross a
+	// partition when the partition is created, instead of stalling them
+	// until the partition is healed. The operations on a reset
+	// connection fail with ErrConnReset.
+	PartitionResetConns
+)
+
+type partitions struct {
+	sync.Mutex
+	mode PartitionMode
+	list []partition
+
+	// healed is closed when the partitions are healed
+	healed chan struct{}
+
+	// stalled is the set of links stalled by the partitions
+	stalled map[*link]struct{}
+}
+
+// partition separates two groups of endpoint names or patterns.
+type partition struct {
+	a, b []string
+}
+
+// separates returns a flag indicating whether or not the partition
+// separates the endpoints with the provided names.
+func (pt partition) separates(x, y string) bool {
+	return (inGroup(pt.a, x) && inGroup(pt.b, y)) ||
+		(inGroup(pt.a, y) && inGroup(pt.b, x))
+}
+
+// inGroup returns a flag indicating whether or not the name is equal
+// to, or matches, one of the names or patterns in the group.
+func inGroup(group []string, name string) bool {
+	for _, pattern := range group {
+		if pattern == name {
+			return true
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// separates returns a flag indicating whether or not one of the
+// partitions separates the endpoints with the provided names. The caller
+// must hold the partitions lock.
+func (pts *partitions) separates(x, y string) bool {
+	for _, pt := range pts.list {
+		if pt.separates(x, y) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetPartitionMode sets how the Provider's partitions affect the dials
+// and connections that cross them. The mode is a combination of the
+// PartitionMode flags.
+//
+// The mode applies to dials made after the call and to the connections
+// that cross partitions created after the call.
+func (p *Provider) SetPartitionMode(mode PartitionMode) {
+	p.parts.Lock()
+	defer p.parts.Unlock()
+	p.parts.mode = mode
+}
+
+// Partition emulates a network partition between two groups of
+// endpoints. Each group is a list of listener and client names, or of
+// patterns that match names using the syntax of path.Match, such as
+// "node-*". The name of a client is the name of the local address used
+// to dial, so clients should be dialed with DialMem or DialMemContext
+// and a named local address in order to be partitioned.
+//
+// While the partition is in place, dials from one group to the other
+// are refused with ErrUnreachable, and the Read and Write operations of
+// the existing connections between the groups block until the partition
+// is healed or their deadlines pass. Please see SetPartitionMode for
+// hanging dials and resetting connections instead.
+//
+// A partition affects the dials made with this Provider and the
+// connections it tracks, which include the connections accepted from
+// its listeners. Partition may be called multiple times to create
+// several partitions, and all of them are removed by Heal.
+func (p *Provider) Partition(groupA, groupB []string) {
+	p.parts.Lock()
+	p.parts.list = append(p.parts.list, partition{
+		a: append([]string(nil), groupA...),
+		b: append([]string(nil), groupB...),
+	})
+	p.parts.Unlock()
+
+	p.endpoints.Lock()
+	conns := make([]*Conn, 0, len(p.endpoints.cache))
+	for c := range p.endpoints.cache {
+		if tc, ok := c.(*Conn); ok {
+			conns = append(conns, tc)
+		}
+	}
+	p.endpoints.Unlock()
+
+	for _, c := range conns {
+		p.applyPartitions(c)
+	}
+}
+
+// Heal removes all of the Provider's partitions. Stalled connections
+// resume and hanging dials proceed. Connections that were reset remain
+// closed.
+func (p *Provider) Heal() {
+	p.parts.Lock()
+	defer p.parts.Unlock()
+	p.parts.list = nil
+	for l := range p.parts.stalled {
+		l.unstall(p)
+	}
+	p.parts.stalled = nil
+	if p.parts.healed != nil {
+		close(p.parts.healed)
+		p.parts.healed = nil
+	}
+}
+
+// applyPartitions stalls or resets the connection if it crosses one of
+// the Provider's partitions.
+func (p *Provider) applyPartitions(c *Conn) {
+	p.parts.Lock()
+	if !p.parts.separates(c.laddr.Name, c.raddr.Name) {
+		p.parts.Unlock()
+		return
+	}
+	if p.parts.mode&PartitionResetConns != 0 {
+		p.parts.Unlock()
+		c.link.resetConns()
+		return
+	}
+
+	// The link is stalled while the lock is held so it cannot miss a
+	// concurrent call to Heal. The link of a closed connection is not
+	// stalled so it is not retained until the partition is healed.
+	defer p.parts.Unlock()
+	if !c.link.stall(p) {
+		return
+	}
+	if p.parts.stalled == nil {
+		p.parts.stalled = map[*link]struct{}{}
+	}
+	p.parts.stalled[c.link] = struct{}{}
+}
+
+// releaseStalled removes the link from the set of links stalled by the
+// Provider's partitions once both sides of its connection are closed.
+func (p *Provider) releaseStalled(l *link) {
+	p.parts.Lock()
+	defer p.parts.Unlock()
+	delete(p.parts.stalled, l)
+}
+
+// waitPartitions returns nil once a dial from laddr to raddr no longer
+// crosses one of the Provider's partitions. If the dial should not hang
+// then ErrUnreachable is returned immediately, and if ctx is done first
+// then the context's error is returned.
+func (p *Provider) waitPartitions(
+	ctx context.Context, laddr, raddr string) error {
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	for {
+		p.parts.Lock()
+		if !p.parts.separates(laddr, raddr) {
+			p.parts.Unlock()
+			return nil
+		}
+		if p.parts.mode&PartitionHangDials == 0 {
+			p.parts.Unlock()
+			return ErrUnreachable
+		}
+		if p.parts.healed == nil {
+			p.parts.healed = make(chan struct{})
+		}
+		healed := p.parts.healed
+		p.parts.Unlock()
+
+		select {
+		case <-healed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package memconn_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/akutz/memconn"
+)
+
+// dialPartitionPair dials the listener from a client with the provided
+// name and returns both sides of the connection.
+func dialPartitionPair(
+	t *testing.T,
+	p *memconn.Provider,
+	network string,
+	lis *memconn.Listener,
+	client string) (*memconn.Conn, *memconn.Conn) {
+
+	t.Helper()
+	c1, err := p.DialMem(
+		network, &memconn.Addr{Name: client}, &memconn.Addr{Name: lis.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := lis.AcceptMemConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c1, c2
+}
+
+func TestPartitionDials(t *testing.T) {
+	p := &memconn.Provider{}
+	defer p.Close()
+	lis, err := p.ListenMem("memu", &memconn.Addr{Name: "node-b1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.Partition([]string{"node-a*"}, []string{"node-b1"})
+
+	_, err = p.DialMem("memu", &memconn.Addr{Name: "node-a1"}, &memconn.Addr{Name: "node-b1"})
+	if !errors.Is(err, memconn.ErrUnreachable) || !errors.Is(err, syscall.EHOSTUNREACH) {
+		t.Fatalf("expected unreachable error: %v", err)
+	}
+
+	// Dials within a group and from names outside of both groups are
+	// not affected.
+	go lis.Accept()
+	if _, err := p.DialMem("memu", &memconn.Addr{Name: "node-b2"}, &memconn.Addr{Name: "node-b1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Heal()
+	go lis.Accept()
+	if _, err := p.DialMem("memu", &memconn.Addr{Name: "node-a1"}, &memconn.Addr{Name: "node-b1"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartitionHangDials(t *testing.T) {
+	p := &memconn.Provider{}
+	defer p.Close()
+	lis, err := p.ListenMem("memb", &memconn.Addr{Name: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, err := lis.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	p.SetPartitionMode(memconn.PartitionHangDials)
+	p.Partition([]string{"a"}, []string{"b"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = p.DialMemContext(ctx, "memb", &memconn.Addr{Name: "a"}, &memconn.Addr{Name: "b"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context error: %v", err)
+	}
+
+	// A hanging dial proceeds once the partition is healed.
+	errs := make(chan error, 1)
+	go func() {
+		_, err := p.DialMem("memb", &memconn.Addr{Name: "a"}, &memconn.Addr{Name: "b"})
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		t.Fatalf("dial did not hang: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	p.Heal()
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartitionStall(t *testing.T) {
+	for _, network := range []string{"memb", "memu"} {
+		t.Run(network, func(t *testing.T) {
+			p := &memconn.Provider{}
+			defer p.Close()
+			lis, err := p.ListenMem(network, &memconn.Addr{Name: "b"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c1, c2 := dialPartitionPair(t, p, network, lis, "a")
+
+			p.Partition([]string{"a"}, []string{"b"})
+
+			// Writes block and reads time out on both sides.
+			if network == "memu" {
+				c1.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+				_, err := c1.Write([]byte("hello"))
+				if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+					t.Fatalf("expected write timeout: %v", err)
+				}
+				c1.SetWriteDeadline(time.Time{})
+			}
+			c2.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+			if _, err := c2.Read(make([]byte, 5)); !errors.Is(err, memconn.ErrDeadlineExceeded) {
+				t.Fatalf("expected read timeout: %v", err)
+			}
+			c2.SetReadDeadline(time.Time{})
+
+			// The connection resumes once the partition is healed.
+			go c1.Write([]byte("hello"))
+			time.Sleep(20 * time.Millisecond)
+			p.Heal()
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(c2, buf); err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != "hello" {
+				t.Fatalf("invalid data: %q", buf)
+			}
+		})
+	}
+}
+
+func TestPartitionReset(t *testing.T) {
+	p := &memconn.Provider{}
+	defer p.Close()
+	lis, err := p.ListenMem("memu", &memconn.Addr{Name: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := dialPartitionPair(t, p, "memu", lis, "a")
+	other, _ := dialPartitionPair(t, p, "memu", lis, "c")
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c2.Read(make([]byte, 1))
+		errs <- err
+	}()
+
+	p.SetPartitionMode(memconn.PartitionResetConns)
+	p.Partition([]string{"a"}, []string{"b"})
+
+	if err := <-errs; !errors.Is(err, memconn.ErrConnReset) || !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("expected reset error: %v", err)
+	}
+	if _, err := c1.Write([]byte("x")); !errors.Is(err, memconn.ErrConnReset) {
+		t.Fatalf("expected reset error: %v", err)
+	}
+
+	// Connections that do not cross the partition are not affected.
+	if err := other.SetDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("connection was reset: %v", err)
+	}
+}
+
+// TestPartitionReleasesClosedConns validates that a partition does not
+// retain the connections that are closed while it is in place.
+func TestPartitionReleasesClosedConns(t *testing.T) {
+	p := &memconn.Provider{}
+	lis, err := p.ListenMem("memu", &memconn.Addr{Name: "node-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	// The connection cannot be finalized since it is part of a cycle,
+	// so the metadata it retains is finalized instead.
+	collected := make(chan struct{})
+	func() {
+		md := &struct{ name string }{"node-a"}
+		runtime.SetFinalizer(md, func(interface{}) { close(collected) })
+		ctx := memconn.WithPeerMetadata(context.Background(), md)
+		go lis.Accept()
+		_, err := p.DialMemContext(
+			ctx, "memu", &memconn.Addr{Name: "node-a"},
+			&memconn.Addr{Name: "node-b"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Partition([]string{"node-a"}, []string{"node-b"})
+
+		// Close both sides of the connection.
+		p.Close()
+	}()
+
+	for i := 0; i < 50; i++ {
+		runtime.GC()
+		select {
+		case <-collected:
+			p.Heal()
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatal("closed connection retained by partition")
+}
@@ -2,6 +2,9 @@
 // and modified in order to optimally support:
 //
 //     * Buffered writes
+//     * Receive-side buffering
+//     * Injectable clocks
+//     * Errors that match the Go stdlib errors using errors.Is
 //     * Custom local and remote address values
 //     * Error values that follow net.Conn's rules regarding
 //       net.OpError
@@ -35,12 +38,13 @@ import (
 // pipeDeadline is an abstraction for handling timeouts.
 type pipeDeadline struct {
 	mu     sync.Mutex // Guards timer and cancel
-	timer  *time.Timer
+	timer  Timer
 	cancel chan struct{} // Must be non-nil
+	clock  Clock
 }
 
-func makePipeDeadline() pipeDeadline {
-	return pipeDeadline{cancel: make(chan struct{})}
+func makePipeDeadline(clock Clock) pipeDeadline {
+	return pipeDeadline{cancel: make(chan struct{}), clock: clock}
 }
 
 // set sets the point in time when the deadline will time out.
@@ -68,11 +72,11 @@ func (d *pipeDeadline) set(t time.Time) {
 	}
 
 	// Time in the future, setup a timer to cancel in the future.
-	if dur := time.Until(t); dur > 0 {
+	if dur := t.Sub(d.clock.Now()); dur > 0 {
 		if closed {
 			d.cancel = make(chan struct{})
 		}
-		d.timer = time.AfterFunc(dur, func() {
+		d.timer = d.clock.AfterFunc(dur, func() {
 			close(d.cancel)
 		})
 		return
@@ -100,11 +104,9 @@ func isClosedChan(c <-chan struct{}) bool {
 	}
 }
 
-type timeoutError struct{}
-
-func (timeoutError) Error() string   { return "deadline exceeded" }
-func (timeoutError) Timeout() bool   { return true }
-func (timeoutError) Temporary() bool { return true }
+// noDeadline is a deadline that never times out. The zero value of
+// pipeDeadline waits on a nil channel, which is never closed.
+var noDeadline pipeDeadline
 
 type pipeAddr struct{}
 
@@ -130,6 +132,12 @@ type pipe struct {
 
 	readDeadline  pipeDeadline
 	writeDeadline pipeDeadline
+
+	// Used by local Read to receive data buffered by remote Write, and
+	// by local Write to buffer data for remote Read. These fields are
+	// nil for pipes created with Pipe().
+	rbuf *rcvBuf
+	wbuf *rcvBuf
 }
 
 // Pipe creates a synchronous, in-memory, full duplex
@@ -149,15 +157,15 @@ func Pipe() (net.Conn, net.Conn) {
 		rdRx: cb1, rdTx: cn1,
 		wrTx: cb2, wrRx: cn2,
 		localDone: done1, remoteDone: done2,
-		readDeadline:  makePipeDeadline(),
-		writeDeadline: makePipeDeadline(),
+		readDeadline:  makePipeDeadline(realClock{}),
+		writeDeadline: makePipeDeadline(realClock{}),
 	}
 	p2 := &pipe{
 		rdRx: cb2, rdTx: cn2,
 		wrTx: cb1, wrRx: cn1,
 		localDone: done2, remoteDone: done1,
-		readDeadline:  makePipeDeadline(),
-		writeDeadline: makePipeDeadline(),
+		readDeadline:  makePipeDeadline(realClock{}),
+		writeDeadline: makePipeDeadline(realClock{}),
 	}
 	return p1, p2
 }
@@ -174,64 +182,188 @@ func (p *pipe) Read(b []byte) (int, error) {
 }
 
 func (p *pipe) read(b []byte) (n int, err error) {
-	switch {
-	case isClosedChan(p.localDone):
-		return 0, io.ErrClosedPipe
-	case isClosedChan(p.remoteDone):
-		return 0, io.EOF
-	case isClosedChan(p.readDeadline.wait()):
-		return 0, timeoutError{}
+	_, n, err = p.readOrTake(b, false, false)
+	return n, err
+}
+
+// readOne is the same as Read except that data in the receive buffer is
+// read from only one payload.
+func (p *pipe) readOne(b []byte) (int, error) {
+	_, n, err := p.readOrTake(b, false, true)
+	if err != nil && err != io.EOF && err != io.ErrClosedPipe {
+		err = &net.OpError{Op: "read", Net: "pipe", Err: err}
+	}
+	return n, err
+}
+
+// take is the same as read except that data in the receive buffer is
+// returned one payload at a time without being copied into b. The
+// returned flag indicates whether or not the caller owns the returned
+// slice; if false then the returned slice is b.
+func (p *pipe) take(b []byte) ([]byte, bool, error) {
+	t, n, err := p.readOrTake(b, true, false)
+	if t != nil {
+		return t, true, err
 	}
+	return b[:n], false, err
+}
 
-	select {
-	case bw := <-p.rdRx:
-		nr := copy(b, bw)
-		p.rdTx <- nr
-		return nr, nil
-	case <-p.localDone:
-		return 0, io.ErrClosedPipe
-	case <-p.remoteDone:
-		return 0, io.EOF
-	case <-p.readDeadline.wait():
-		return 0, timeoutError{}
+// readOrTake reads data into b, or takes a payload from the receive
+// buffer if take is true. If one is true then data in the receive buffer
+// is read from only one payload.
+func (p *pipe) readOrTake(
+	b []byte, take, one bool) (t []byte, n int, err error) {
+
+	for {
+		// Data in the receive buffer is returned even if the remote
+		// side of the pipe is closed.
+		var changed <-chan struct{}
+		if p.rbuf != nil &&
+			!isClosedChan(p.localDone) &&
+			!isClosedChan(p.readDeadline.wait()) {
+
+			var ok bool
+			if take {
+				if t, ok, changed = p.rbuf.take(); ok {
+					return t, 0, nil
+				}
+			} else if n, ok, changed = p.rbuf.read(b, one); ok {
+				return nil, n, nil
+			}
+		}
+
+		switch {
+		case isClosedChan(p.localDone):
+			return nil, 0, io.ErrClosedPipe
+		case isClosedChan(p.remoteDone):
+			return nil, 0, io.EOF
+		case isClosedChan(p.readDeadline.wait()):
+			return nil, 0, ErrDeadlineExceeded
+		}
+
+		select {
+		case bw := <-p.rdRx:
+			nr := copy(b, bw)
+			p.rdTx <- nr
+			return nil, nr, nil
+		case <-changed:
+		case <-p.localDone:
+			return nil, 0, io.ErrClosedPipe
+		case <-p.remoteDone:
+			if p.rbuf == nil || p.rbuf.len() == 0 {
+				return nil, 0, io.EOF
+			}
+		case <-p.readDeadline.wait():
+			return nil, 0, ErrDeadlineExceeded
+		}
 	}
 }
 
 func (p *pipe) Write(b []byte) (int, error) {
-	n, err := p.write(b)
+	n, _, err := p.writeWith(b, &p.writeDeadline, false)
+	return n, err
+}
+
+// writeWith is the same as Write except the provided deadline is used
+// instead of the pipe's write deadline. If owned is true then the caller
+// transfers ownership of b to the pipe, and b may be placed into the
+// remote receive buffer without being copied. The returned flag reports
+// whether or not that happened, in which case the caller must no longer
+// modify b.
+func (p *pipe) writeWith(
+	b []byte, d *pipeDeadline, owned bool) (int, bool, error) {
+
+	n, retained, err := p.write(b, d, owned)
 	if err != nil && err != io.ErrClosedPipe {
 		err = &net.OpError{Op: "write", Net: "pipe", Err: err}
 	}
-	return n, err
+	return n, retained, err
 }
 
-func (p *pipe) write(b []byte) (n int, err error) {
+func (p *pipe) write(
+	b []byte, d *pipeDeadline, owned bool) (n int, retained bool, err error) {
+
+	switch {
+	case isClosedChan(p.localDone):
+		return 0, false, io.ErrClosedPipe
+	case isClosedChan(p.remoteDone):
+		return 0, false, io.ErrClosedPipe
+	case isClosedChan(d.wait()):
+		return 0, false, ErrDeadlineExceeded
+	}
+
+	p.wrMu.Lock() // Ensure entirety of b is written together
+	defer p.wrMu.Unlock()
+	return p.writeLocked(b, d, owned)
+}
+
+// writev writes each of the provided slices in order. No other Write
+// operation may be interleaved with the slices.
+func (p *pipe) writev(v [][]byte, d *pipeDeadline) (n int64, err error) {
 	switch {
 	case isClosedChan(p.localDone):
 		return 0, io.ErrClosedPipe
 	case isClosedChan(p.remoteDone):
 		return 0, io.ErrClosedPipe
-	case isClosedChan(p.writeDeadline.wait()):
-		return 0, timeoutError{}
+	case isClosedChan(d.wait()):
+		return 0, ErrDeadlineExceeded
 	}
 
-	p.wrMu.Lock() // Ensure entirety of b is written together
+	p.wrMu.Lock() // Ensure entirety of v is written together
 	defer p.wrMu.Unlock()
+	for _, b := range v {
+		nw, _, err := p.writeLocked(b, d, false)
+		n += int64(nw)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// writeLocked writes b. The returned flag indicates whether or not b,
+// which is only possible if owned is true, was placed into the remote
+// receive buffer. The caller must hold wrMu.
+func (p *pipe) writeLocked(
+	b []byte, d *pipeDeadline, owned bool) (n int, retained bool, err error) {
+
 	for once := true; once || len(b) > 0; once = false {
+		// If the remote side of the pipe has a receive buffer then copy
+		// as much of b into it as possible. Otherwise wait until the
+		// buffer is empty before matching b directly with a remote Read
+		// so the order of the data is preserved.
+		wrTx, changed := p.wrTx, (<-chan struct{})(nil)
+		if p.wbuf != nil {
+			var (
+				nw     int
+				direct bool
+			)
+			if nw, direct, changed = p.wbuf.write(b, owned); !direct {
+				b = b[nw:]
+				n += nw
+				retained = retained || (owned && nw > 0)
+				if nw > 0 || len(b) == 0 {
+					continue
+				}
+				wrTx = nil
+			}
+		}
+
 		select {
-		case p.wrTx <- b:
+		case wrTx <- b:
 			nw := <-p.wrRx
 			b = b[nw:]
 			n += nw
+		case <-changed:
 		case <-p.localDone:
-			return n, io.ErrClosedPipe
+			return n, retained, io.ErrClosedPipe
 		case <-p.remoteDone:
-			return n, io.ErrClosedPipe
-		case <-p.writeDeadline.wait():
-			return n, timeoutError{}
+			return n, retained, io.ErrClosedPipe
+		case <-d.wait():
+			return n, retained, ErrDeadlineExceeded
 		}
 	}
-	return n, nil
+	return n, retained, nil
 }
 
 func (p *pipe) SetDeadline(t time.Time) error {
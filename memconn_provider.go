@@ -2,8 +2,8 @@ package memconn
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -13,11 +13,50 @@ import (
 type Provider struct {
 	nets      networkMap
 	listeners listenerCache
+
+	// parent is the Provider searched for listener names that are not
+	// defined by this Provider. Please see the NewChild function for
+	// more information.
+	parent *Provider
+
+	clock   Clock
+	clockMu sync.RWMutex
+
+	endpoints endpointCache
+
+	tlsOpts tlsOptions
+
+	parts partitions
+
+	chaos chaosOptions
+
+	segOpts segmentOptions
+}
+
+type tlsOptions struct {
+	sync.Mutex
+	ca     *CertAuthority
+	mutual bool
+}
+
+type endpointCache struct {
+	sync.Mutex
+	cache  map[interface{}]endpoint
+	seq    uint64
+	stacks bool
 }
 
 type listenerCache struct {
 	sync.RWMutex
-	cache map[string]*Listener
+	cache  map[listenerKey]*Listener
+	shared bool
+}
+
+// listenerKey is the key used to cache listeners. The network is empty
+// when the Provider uses a shared namespace.
+type listenerKey struct {
+	network string
+	name    string
 }
 
 type networkMap struct {
@@ -53,23 +92,147 @@ func (p *Provider) mapNetwork(network string) string {
 	if to, ok := p.nets.cache[network]; ok {
 		return to
 	}
+	if p.parent != nil {
+		return p.parent.mapNetwork(network)
+	}
 	return network
 }
 
+// NewChild returns a new Provider with its own namespace. Dials made
+// with the child Provider connect to the child's listeners, and if the
+// child has no listener with the dialed name then the dial falls back to
+// the listeners of this Provider and its ancestors. Listening with the
+// child Provider never affects this Provider, so a child can override a
+// name defined by its parent, for example to replace a service with a
+// fake.
+//
+// The child uses this Provider's network mappings and Clock unless they
+// are set on the child.
+func (p *Provider) NewChild() *Provider {
+	return &Provider{parent: p}
+}
+
+// Close closes all of the listeners and connections created by this
+// Provider. Connections accepted from this Provider's listeners are
+// included, as are connections dialed with this Provider to the
+// listeners of other Providers. Buffered connections are closed without
+// waiting for pending writes.
+//
+// The listeners and connections of the Provider's parent and children
+// are not affected. The Provider may still be used after it is closed.
+func (p *Provider) Close() error {
+	p.endpoints.Lock()
+	eps := make([]interface{}, 0, len(p.endpoints.cache))
+	for c := range p.endpoints.cache {
+		eps = append(eps, c)
+	}
+	p.endpoints.Unlock()
+
+	for _, c := range eps {
+		switch tc := c.(type) {
+		case *Listener:
+			tc.Close()
+		case *Conn:
+			tc.closeNow()
+		case io.Closer:
+			tc.Close()
+		}
+	}
+	return nil
+}
+
+// SetSharedNamespace enables or disables sharing a single namespace for
+// listener names across all network types.
+//
+// By default each network type has its own namespace, so a "memb"
+// listener and a "memu" listener may have the same name, and dialing a
+// name that is only listened on by a different network type fails with
+// ErrWrongNetwork.
+//
+// When the namespace is shared, listening on a name that is in use by
+// any network type fails, and dialing a name connects to the listener
+// regardless of its network type. The remote address of the dialed
+// connection has the network type of the listener.
+//
+// This function should be called before any listeners are created.
+// Listeners created before the call are still closed correctly, but
+// cannot be dialed once the namespace mode changes.
+func (p *Provider) SetSharedNamespace(shared bool) {
+	p.listeners.Lock()
+	defer p.listeners.Unlock()
+	p.listeners.shared = shared
+}
+
+// listenerKey returns the key for the listener with the provided name
+// on the provided network. The caller must hold the listeners lock.
+func (p *Provider) listenerKey(network, name string) listenerKey {
+	if p.listeners.shared {
+		return listenerKey{name: name}
+	}
+	return listenerKey{network: p.mapNetwork(network), name: name}
+}
+
+// SetClock sets the Clock used to tell time and schedule timers for the
+// deadlines and close timeouts of the connections created by this
+// Provider. Providing a Clock that is advanced manually makes tests
+// that exercise deadlines deterministic.
+//
+// Only connections dialed after the Clock is set use the Clock. Calling
+// SetClock(nil) restores the default Clock, which uses real time.
+func (p *Provider) SetClock(c Clock) {
+	p.clockMu.Lock()
+	defer p.clockMu.Unlock()
+	p.clock = c
+}
+
+func (p *Provider) getClock() Clock {
+	p.clockMu.RLock()
+	defer p.clockMu.RUnlock()
+	if p.clock == nil {
+		if p.parent != nil {
+			return p.parent.getClock()
+		}
+		return realClock{}
+	}
+	return p.clock
+}
+
 // Listen begins listening at address for the specified network.
 //
 // Known networks are "memb" (memconn buffered) and "memu" (memconn unbuffered).
 //
+// On Linux the networks "shmb" (shared memory buffered) and "shmu"
+// (shared memory unbuffered) connect processes on the same host. Their
+// listener names are shared by all of the current user's processes.
+//
+// Since their peers may be in other processes, the shared memory
+// networks only support part of the Provider model. Their listeners
+// and connections are tracked, so they are reported by Leaks and closed
+// by Close, and the Provider's network mappings apply. However:
+//
+//   - Their listeners and connections are not *Listener and *Conn
+//     values, so ListenMem, DialMem, and the functions of those types,
+//     such as SetAdmitFunc, Shutdown, SetReadBuffer, Flush, SetNoDelay,
+//     SetSegmentation, and PeerMetadata, are not available.
+//   - Their names are not scoped to the Provider or its parent, so
+//     NewChild and SetSharedNamespace do not affect them.
+//   - Partition, SetChaos, SetSegmentation, and SetClock do not affect
+//     them.
+//   - A peer process that exits without closing its connections is
+//     noticed within 100ms, since waits poll whether the peer is alive.
+//
 // When the specified address is already in use on the specified
 // network an error is returned.
 //
 // When the provided network is unknown the operation defers to
 // net.Dial.
 func (p *Provider) Listen(network, address string) (net.Listener, error) {
-	switch p.mapNetwork(network) {
+	switch mapped := p.mapNetwork(network); mapped {
 	case networkMemb, networkMemu:
 		return p.ListenMem(
 			network, &Addr{Name: address, network: network})
+	case networkShmb, networkShmu:
+		return p.listenShm(mapped, address)
 	default:
 		return net.Listen(network, address)
 	}
@@ -81,6 +244,9 @@ func (p *Provider) Listen(network, address string) (net.Listener, error) {
 //
 // If laddr is nil then ListenMem listens on "localhost" on the
 // specified network.
+//
+// The shared memory networks "shmb" and "shmu" are not supported by
+// ListenMem. Please see Listen for more information.
 func (p *Provider) ListenMem(network string, laddr *Addr) (*Listener, error) {
 
 	switch p.mapNetwork(network) {
@@ -98,7 +264,7 @@ func (p *Provider) ListenMem(network string, laddr *Addr) (*Listener, error) {
 			Source: laddr,
 			Net:    network,
 			Op:     "listen",
-			Err:    errors.New("unknown network"),
+			Err:    net.UnknownNetworkError(network),
 		}
 	}
 
@@ -106,44 +272,98 @@ func (p *Provider) ListenMem(network string, laddr *Addr) (*Listener, error) {
 	defer p.listeners.Unlock()
 
 	if p.listeners.cache == nil {
-		p.listeners.cache = map[string]*Listener{}
+		p.listeners.cache = map[listenerKey]*Listener{}
 	}
 
-	if _, ok := p.listeners.cache[laddr.Name]; ok {
+	key := p.listenerKey(network, laddr.Name)
+	if _, ok := p.listeners.cache[key]; ok {
 		return nil, &net.OpError{
 			Addr:   laddr,
 			Source: laddr,
 			Net:    network,
 			Op:     "listen",
-			Err:    errors.New("addr unavailable"),
+			Err:    ErrAddrInUse,
 		}
 	}
 
 	l := &Listener{
 		addr: *laddr,
+		key:  key,
+		prov: p,
 		done: make(chan struct{}),
-		rmvd: make(chan struct{}),
+		shut: make(chan struct{}),
 		rcvr: make(chan *Conn, 1),
 	}
 
-	// Start a goroutine that removes the listener from
-	// the cache once the listener is closed.
-	go func() {
-		<-l.done
-		p.listeners.Lock()
-		defer p.listeners.Unlock()
-		delete(p.listeners.cache, laddr.Name)
-		close(l.rmvd)
-	}()
-
-	p.listeners.cache[laddr.Name] = l
+	p.listeners.cache[key] = l
+	p.track(l, "listener", l.addr, nil)
 	return l, nil
 }
 
+// removeListener removes the listener from the cache when the listener
+// is closed.
+func (p *Provider) removeListener(l *Listener) {
+	p.listeners.Lock()
+	defer p.listeners.Unlock()
+	if p.listeners.cache[l.key] == l {
+		delete(p.listeners.cache, l.key)
+	}
+	p.untrack(l)
+}
+
+// lookupListener returns the listener with the provided name on the
+// provided network. If this Provider has no such listener then its
+// parent is searched. If no listener is found then the returned flag
+// indicates whether or not the name is listened on by another network.
+func (p *Provider) lookupListener(
+	network, name string) (l *Listener, wrongNetwork bool) {
+
+	p.listeners.RLock()
+	l, ok := p.listeners.cache[p.listenerKey(network, name)]
+	wrongNetwork = !ok && p.listenedOnOtherNetwork(network, name)
+	p.listeners.RUnlock()
+
+	if ok {
+		return l, false
+	}
+	if p.parent != nil {
+		pl, pw := p.parent.lookupListener(network, name)
+		if pl != nil {
+			return pl, false
+		}
+		wrongNetwork = wrongNetwork || pw
+	}
+	return nil, wrongNetwork
+}
+
+// listenedOnOtherNetwork returns a flag indicating whether or not there
+// is a listener with the provided name on a network other than the
+// provided network. The caller must hold the listeners lock.
+func (p *Provider) listenedOnOtherNetwork(network, name string) bool {
+	if p.listeners.shared {
+		return false
+	}
+	network = p.mapNetwork(network)
+	for _, other := range []string{networkMemb, networkMemu} {
+		if other == network {
+			continue
+		}
+		if _, ok := p.listeners.cache[listenerKey{other, name}]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 // Dial dials a named connection.
 //
 // Known networks are "memb" (memconn buffered) and "memu" (memconn unbuffered).
 //
+// On Linux the networks "shmb" (shared memory buffered) and "shmu"
+// (shared memory unbuffered) connect processes on the same host. Their
+// listener names are shared by all of the current user's processes.
+// Please see Listen for the features they do not support.
+//
 // When the provided network is unknown the operation defers to
 // net.Dial.
 func (p *Provider) Dial(network, address string) (net.Conn, error) {
@@ -160,6 +380,9 @@ func (p *Provider) Dial(network, address string) (net.Conn, error) {
 //
 // If raddr is nil then the "localhost" endpoint is used on the
 // specified network.
+//
+// The shared memory networks "shmb" and "shmu" are not supported by
+// DialMem. Please see Listen for more information.
 func (p *Provider) DialMem(
 	network string, laddr, raddr *Addr) (*Conn, error) {
 
@@ -174,13 +397,15 @@ func (p *Provider) DialContext(
 	ctx context.Context,
 	network, address string) (net.Conn, error) {
 
-	switch p.mapNetwork(network) {
+	switch mapped := p.mapNetwork(network); mapped {
 	case networkMemb, networkMemu:
 		return p.DialMemContext(
 			ctx, network, nil, &Addr{
 				Name:    address,
 				network: network,
 			})
+	case networkShmb, networkShmu:
+		return p.dialShm(ctx, mapped, address)
 	default:
 		if ctx == nil {
 			return net.Dial(network, address)
@@ -221,25 +446,62 @@ func (p *Provider) DialMemContext(
 			Source: laddr,
 			Net:    network,
 			Op:     "dial",
-			Err:    errors.New("unknown network"),
+			Err:    net.UnknownNetworkError(network),
 		}
 	}
 
-	p.listeners.RLock()
-	defer p.listeners.RUnlock()
-
-	if l, ok := p.listeners.cache[raddr.Name]; ok {
+	// The lock is not held while dialing the listener since dialing
+	// blocks until the connection is accepted.
+	l, wrongNetwork := p.lookupListener(network, raddr.Name)
+	if l != nil {
 		// Update the provided raddr with the actual network type used
 		// by the listener.
 		raddr.network = l.addr.network
-		return l.dial(ctx, network, *laddr, *raddr)
+
+		// Refuse or delay the dial if it crosses a partition of either
+		// the dialing Provider or the listener's Provider.
+		err := p.waitPartitions(ctx, laddr.Name, raddr.Name)
+		if err == nil && l.prov != p {
+			err = l.prov.waitPartitions(ctx, laddr.Name, raddr.Name)
+		}
+		if err != nil {
+			return nil, &net.OpError{
+				Addr:   raddr,
+				Source: laddr,
+				Net:    network,
+				Op:     "dial",
+				Err:    err,
+			}
+		}
+
+		// Refuse the dial or inject faults into its connection if chaos
+		// mode is enabled.
+		chaos, n, refuse := p.chaosDial(*laddr, *raddr)
+		if refuse {
+			return nil, &net.OpError{
+				Addr:   raddr,
+				Source: laddr,
+				Net:    network,
+				Op:     "dial",
+				Err:    ErrConnRefused,
+			}
+		}
+		c, err := l.dial(ctx, p, network, *laddr, *raddr)
+		if err == nil && chaos != nil {
+			chaos.schedule(c, n)
+		}
+		return c, err
 	}
 
+	err := ErrConnRefused
+	if wrongNetwork {
+		err = ErrWrongNetwork
+	}
 	return nil, &net.OpError{
 		Addr:   raddr,
 		Source: laddr,
 		Net:    network,
 		Op:     "dial",
-		Err:    errors.New("unknown remote address"),
+		Err:    err,
 	}
 }
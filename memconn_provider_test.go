@@ -0,0 +1,88 @@
+package memconn_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/akutz/memconn"
+)
+
+// TestChildProvider validates that a child Provider has its own
+// namespace, falls back to its parent, and only closes its own
+// listeners and connections.
+func TestChildProvider(t *testing.T) {
+	parent := &memconn.Provider{}
+	child := parent.NewChild()
+
+	// listen starts a server that writes reply to each accepted
+	// connection.
+	listen := func(p *memconn.Provider, name, reply string) {
+		lis, err := p.ListenMem("memu", &memconn.Addr{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { lis.Close() })
+		go func() {
+			for {
+				c, err := lis.Accept()
+				if err != nil {
+					return
+				}
+				c.Write([]byte(reply))
+			}
+		}()
+	}
+
+	dial := func(p *memconn.Provider, name string) (string, error) {
+		c, err := p.DialMem("memu", nil, &memconn.Addr{Name: name})
+		if err != nil {
+			return "", err
+		}
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatal(err)
+		}
+		return string(buf), nil
+	}
+
+	// Both providers define "db", only the parent defines "queue".
+	listen(parent, "db", "p")
+	listen(parent, "queue", "q")
+	listen(child, "db", "c")
+
+	// The child's "db" overrides the parent's, and the child falls back
+	// to the parent's "queue".
+	for _, tc := range []struct {
+		p          *memconn.Provider
+		name, resp string
+	}{
+		{child, "db", "c"},
+		{child, "queue", "q"},
+		{parent, "db", "p"},
+	} {
+		if v, err := dial(tc.p, tc.name); err != nil {
+			t.Fatal(err)
+		} else if v != tc.resp {
+			t.Fatalf("%s: exp=%s act=%s", tc.name, tc.resp, v)
+		}
+	}
+
+	// Closing the child closes the child's listener and the connections
+	// dialed by the child, but not the parent's listeners.
+	if err := child.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.CheckLeaks(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := dial(child, "db"); err != nil {
+		t.Fatal(err)
+	} else if v != "p" {
+		t.Fatalf("db after close: exp=p act=%s", v)
+	}
+	if v, err := dial(parent, "queue"); err != nil {
+		t.Fatal(err)
+	} else if v != "q" {
+		t.Fatalf("queue after close: exp=q act=%s", v)
+	}
+}
@@ -0,0 +1,150 @@
+package memconn
+
+import "sync"
+
+// rcvBuf is the receive buffer for one side of a connection. The remote
+// side of the connection writes into the buffer and the local side of
+// the connection reads from it.
+//
+// A receive buffer with a capacity of zero does not buffer any data.
+// Instead Write operations are matched directly with Read operations.
+type rcvBuf struct {
+	// max is the capacity of the buffer. Please see the SetReadBuffer
+	// function for more information.
+	max int
+
+	// data is a FIFO list of the payloads written to the buffer
+	data [][]byte
+
+	// n is the total number of bytes in data
+	n int
+
+	// changed is closed each time data is written to or read from the
+	// buffer, or the buffer's capacity is changed. It is only created
+	// when an operation needs to wait, so operations that do not wait
+	// do not allocate a channel.
+	changed chan struct{}
+
+	// mu guards access to all of the buffer's fields
+	mu sync.Mutex
+}
+
+func newRcvBuf() *rcvBuf {
+	return &rcvBuf{}
+}
+
+// notify wakes up the goroutines waiting on the changed channel, if any.
+// The caller must hold mu.
+func (r *rcvBuf) notify() {
+	if r.changed != nil {
+		close(r.changed)
+		r.changed = nil
+	}
+}
+
+// waitLocked returns the channel that is closed when the buffer changes.
+// The caller must hold mu.
+func (r *rcvBuf) waitLocked() <-chan struct{} {
+	if r.changed == nil {
+		r.changed = make(chan struct{})
+	}
+	return r.changed
+}
+
+// setMax sets the capacity of the buffer.
+func (r *rcvBuf) setMax(max int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.max = max
+	r.notify()
+}
+
+// len returns the number of bytes in the buffer.
+func (r *rcvBuf) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.n
+}
+
+// read copies data from the buffer into b. If one is true then data is
+// copied from only the first payload. The ok flag is false if the buffer
+// is empty, in which case the returned channel is closed when the buffer
+// changes.
+func (r *rcvBuf) read(
+	b []byte, one bool) (n int, ok bool, changed <-chan struct{}) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.n == 0 {
+		return 0, false, r.waitLocked()
+	}
+	for n < len(b) && len(r.data) > 0 {
+		nr := copy(b[n:], r.data[0])
+		n += nr
+		if nr == len(r.data[0]) {
+			r.data[0] = nil
+			r.data = r.data[1:]
+		} else {
+			r.data[0] = r.data[0][nr:]
+		}
+		if one {
+			break
+		}
+	}
+	r.n -= n
+	if n > 0 {
+		r.notify()
+	}
+	return n, true, nil
+}
+
+// take removes the first payload from the buffer and returns it. The ok
+// flag is false if the buffer is empty, in which case the returned
+// channel is closed when the buffer changes.
+func (r *rcvBuf) take() (p []byte, ok bool, changed <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.n == 0 {
+		return nil, false, r.waitLocked()
+	}
+	p = r.data[0]
+	r.data[0] = nil
+	r.data = r.data[1:]
+	r.n -= len(p)
+	r.notify()
+	return p, true, nil
+}
+
+// write copies as much of b into the buffer as its capacity allows and
+// returns the number of bytes copied. If owned is true then b is placed
+// into the buffer without being copied. If the buffer has no capacity
+// and is empty then direct is true, meaning b should be matched directly
+// with a Read operation. Otherwise, if no bytes were copied, the
+// returned channel is closed when the buffer changes.
+func (r *rcvBuf) write(
+	b []byte, owned bool) (n int, direct bool, changed <-chan struct{}) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.max == 0 {
+		if r.n == 0 {
+			return 0, true, nil
+		}
+		return 0, false, r.waitLocked()
+	}
+	if n = r.max - r.n; n > len(b) {
+		n = len(b)
+	}
+	if n <= 0 {
+		return 0, false, r.waitLocked()
+	}
+	p := b[:n:n]
+	if !owned {
+		p = make([]byte, n)
+		copy(p, b)
+	}
+	r.data = append(r.data, p)
+	r.n += n
+	r.notify()
+	return n, false, nil
+}
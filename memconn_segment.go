@@ -0,0 +1,137 @@
+package memconn
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// Segmentation configures how the data written to a connection is split
+// into segments when it is read. Each Read operation returns at most one
+// segment, like a Read from a TCP connection that returns the data of a
+// single packet, which exposes code that assumes a Read returns a whole
+// message.
+//
+// The zero value disables segmentation.
+type Segmentation struct {
+	// MaxSize is the maximum size of a segment in bytes. A value of zero
+	// disables segmentation.
+	MaxSize int
+
+	// Random indicates whether or not the size of each segment is chosen
+	// at random from one to MaxSize, instead of every segment being
+	// MaxSize bytes. The sizes are drawn from a source seeded with Seed,
+	// so a run can be replayed with the same seed.
+	Random bool
+	Seed   int64
+}
+
+type segmentOptions struct {
+	sync.Mutex
+	cfg Segmentation
+}
+
+// segmenter splits the data read from a connection into segments.
+type segmenter struct {
+	// enabled is non-zero while segmentation is enabled. It is read
+	// without holding mu so Read operations on connections without
+	// segmentation remain cheap.
+	enabled int32
+
+	max int
+	rng *rand.Rand
+
+	// left is the number of bytes that remain in the current segment.
+	// A new segment begins once left is zero.
+	left int
+
+	// mu guards max, rng, and left
+	mu sync.Mutex
+}
+
+func (s *segmenter) set(cfg Segmentation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.max, s.rng, s.left = cfg.MaxSize, nil, 0
+	if cfg.Random {
+		s.rng = rand.New(rand.NewSource(cfg.Seed))
+	}
+	if s.max > 0 {
+		atomic.StoreInt32(&s.enabled, 1)
+	} else {
+		atomic.StoreInt32(&s.enabled, 0)
+	}
+}
+
+func (s *segmenter) isEnabled() bool {
+	return atomic.LoadInt32(&s.enabled) != 0
+}
+
+// limit returns the number of bytes, no more than n, that the next Read
+// operation may return.
+func (s *segmenter) limit(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n == 0 || s.max == 0 {
+		return n
+	}
+	if s.left == 0 {
+		s.left = s.max
+		if s.rng != nil {
+			s.left = s.rng.Intn(s.max) + 1
+		}
+	}
+	if n > s.left {
+		n = s.left
+	}
+	return n
+}
+
+// consume records that a Read operation limited to lim bytes returned n
+// bytes. If n is less than lim then the written data ended, so the
+// current segment ends as well.
+func (s *segmenter) consume(n, lim int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.left -= n; n < lim || s.left < 0 {
+		s.left = 0
+	}
+}
+
+// SetSegmentation sets how the data written by the remote side of the
+// connection is split into segments when it is read from this side of
+// the connection. Each Read operation returns at most one segment, and
+// a segment never contains the data of more than one Write operation.
+//
+// Please see the Provider's SetSegmentation function to segment all of
+// the connections created by a Provider.
+func (c *Conn) SetSegmentation(s Segmentation) {
+	c.seg.set(s)
+}
+
+// readSegment reads at most one segment into b.
+func (c *Conn) readSegment(b []byte) (int, error) {
+	lim := c.seg.limit(len(b))
+	n, err := c.pipe.readOne(b[:lim])
+	c.seg.consume(n, lim)
+	return n, err
+}
+
+// SetSegmentation sets how the data read from the connections created by
+// this Provider is split into segments. The setting applies to both sides
+// of the connections dialed with this Provider and accepted from its
+// listeners after the call, and the random sizes of each connection are
+// drawn from a separate source seeded with the same seed.
+//
+// Please see the SetSegmentation function of Conn for more information.
+func (p *Provider) SetSegmentation(s Segmentation) {
+	p.segOpts.Lock()
+	defer p.segOpts.Unlock()
+	p.segOpts.cfg = s
+}
+
+func (p *Provider) getSegmentation() Segmentation {
+	p.segOpts.Lock()
+	defer p.segOpts.Unlock()
+	return p.segOpts.cfg
+}
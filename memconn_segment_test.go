@@ -0,0 +1,150 @@
+package memconn_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/akutz/memconn"
+	"github.com/akutz/memconn/memconntest"
+)
+
+func TestSegmentationConnMemb(t *testing.T) {
+	memconntest.TestConn(t, makeSegmentedPipe("memb"))
+}
+
+func TestSegmentationConnMemu(t *testing.T) {
+	memconntest.TestConn(t, makeSegmentedPipe("memu"))
+}
+
+func makeSegmentedPipe(network string) memconntest.MakePipe {
+	return func() (c1, c2 net.Conn, stop func(), err error) {
+		p := &memconn.Provider{}
+		p.SetSegmentation(memconn.Segmentation{MaxSize: 7, Random: true, Seed: 1})
+		lis, err := p.ListenMem(network, nil)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		defer lis.Close()
+		client, err := p.DialMem(network, nil, nil)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		server, err := lis.AcceptMemConn()
+		if err != nil {
+			client.Close()
+			return nil, nil, nil, err
+		}
+		for _, c := range []*memconn.Conn{client, server} {
+			c.SetBufferSize(4096)
+			c.SetCloseTimeout(time.Second)
+		}
+		return client, server, func() { p.Close() }, nil
+	}
+}
+
+// readSegments reads n bytes from c and returns the data of each Read.
+func readSegments(t *testing.T, c net.Conn, n int) []string {
+	t.Helper()
+	var segs []string
+	buf := make([]byte, 64)
+	for n > 0 {
+		nr, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segs = append(segs, string(buf[:nr]))
+		n -= nr
+	}
+	return segs
+}
+
+func TestSegmentationMaxSize(t *testing.T) {
+	for _, network := range []string{"memb", "memu"} {
+		for _, rcvbuf := range []int{0, 1024} {
+			p := &memconn.Provider{}
+			lis, err := p.ListenMem(network, &memconn.Addr{Name: "b"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c1, c2 := dialPartitionPair(t, p, network, lis, "a")
+			c2.SetSegmentation(memconn.Segmentation{MaxSize: 3})
+			c2.SetReadBuffer(rcvbuf)
+
+			// Segments do not span writes, even when both writes are
+			// in the receive buffer.
+			go func() {
+				c1.Write([]byte("hello"))
+				c1.Write([]byte("world"))
+			}()
+			segs := readSegments(t, c2, 10)
+			exp := []string{"hel", "lo", "wor", "ld"}
+			if !reflect.DeepEqual(segs, exp) {
+				t.Errorf("%s rcvbuf=%d: segments=%q, expected=%q",
+					network, rcvbuf, segs, exp)
+			}
+
+			// The other side of the connection is not segmented.
+			go c2.Write([]byte("hello world"))
+			if segs := readSegments(t, c1, 11); len(segs) != 1 {
+				t.Errorf("%s rcvbuf=%d: unexpected segments=%q",
+					network, rcvbuf, segs)
+			}
+			p.Close()
+		}
+	}
+}
+
+func TestSegmentationRandom(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	run := func(seed int64) []int {
+		p := &memconn.Provider{}
+		defer p.Close()
+		p.SetSegmentation(memconn.Segmentation{MaxSize: 16, Random: true, Seed: seed})
+		lis, err := p.ListenMem("memb", &memconn.Addr{Name: "b"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c1, c2 := dialPartitionPair(t, p, "memb", lis, "a")
+		c1.SetCloseTimeout(10 * time.Second)
+		go func() {
+			c1.Write(data)
+			c1.Close()
+		}()
+
+		var (
+			sizes []int
+			got   []byte
+			buf   = make([]byte, 64)
+		)
+		for {
+			n, err := c2.Read(buf)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n > 16 {
+				t.Fatalf("segment too large: %d", n)
+			}
+			sizes = append(sizes, n)
+			got = append(got, buf[:n]...)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("invalid data")
+		}
+		return sizes
+	}
+
+	a, b := run(1), run(1)
+	if !reflect.DeepEqual(a, b) {
+		t.Fatalf("replay differs:\n%v\n%v", a, b)
+	}
+	if c := run(2); reflect.DeepEqual(a, c) {
+		t.Fatal("different seeds produced the same segments")
+	}
+}
@@ -0,0 +1,1029 @@
+package memconn
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The "shmb" and "shmu" networks connect processes on the same host
+// using shared memory. Each listener and connection is a file in
+// /dev/shm that both processes map into memory. A connection is a pair
+// of ring buffers, one for each direction, and the processes signal
+// each other using futexes on words in the shared memory.
+//
+// Anonymous memory created with memfd_create cannot be opened by name
+// from another process, so named files are used instead. A connection's
+// file is removed as soon as both processes have mapped it, so only the
+// files of listeners are visible while the processes run.
+
+const (
+	shmMagic   uint32 = 0x6d636f6e // "mcon"
+	shmVersion uint32 = 1
+
+	// shmRingSize is the capacity of the ring buffer used for each
+	// direction of a connection.
+	shmRingSize = 256 * 1024
+
+	// shmBacklog is the number of dials that may be pending a call to
+	// Accept. Once the backlog is full, dials wait for room.
+	shmBacklog = 64
+
+	// shmPollInterval is the longest a wait blocks before checking
+	// whether the remote process is still running, so a process that
+	// exits without closing its connections does not block its peers
+	// forever.
+	shmPollInterval = 100 * time.Millisecond
+
+	// shmMaxName is the maximum length of a dialer's address name
+	// recorded in a connection's header.
+	shmMaxName = 256
+)
+
+// The layout of a listener's shared memory.
+const (
+	lisMagic   = 0  // uint32
+	lisVersion = 4  // uint32
+	lisPID     = 8  // uint32
+	lisClosed  = 12 // uint32
+	lisSeq     = 16 // uint32, futex
+	lisWaiters = 20 // uint32
+	lisHead    = 24 // uint64, the number of slots claimed by dialers
+	lisTail    = 32 // uint64, the number of slots consumed by Accept
+	lisSlots   = 64 // [shmBacklog]uint64, the IDs of dialed connections
+	lisSize    = 4096
+)
+
+// The layout of a connection's shared memory. The first direction
+// carries data from the dialer to the listener's process and the second
+// direction carries data back to the dialer.
+const (
+	connMagic   = 0  // uint32
+	connVersion = 4  // uint32
+	connDialPID = 8  // uint32
+	connLisPID  = 12 // uint32
+	connSeq     = 16 // uint32, futex
+	connWaiters = 20 // uint32
+	connState   = 24 // uint32
+	connNameLen = 28 // uint32
+	connName    = 32 // [shmMaxName]byte, the dialer's address name
+	connDirs    = 320
+	connDirSize = 64
+	connData    = 4096
+	connSize    = connData + 2*shmRingSize
+)
+
+// The layout of one direction of a connection, relative to the
+// direction's offset.
+const (
+	dirHead    = 0  // uint64, the number of bytes written
+	dirTail    = 8  // uint64, the number of bytes read
+	dirSeq     = 16 // uint32, futex
+	dirWaiters = 20 // uint32
+	dirWClosed = 24 // uint32, the writing side is closed
+	dirRClosed = 28 // uint32, the reading side is closed
+)
+
+// The states of a connection that is being dialed.
+const (
+	connPending uint32 = iota
+	connAccepted
+	connCanceled
+)
+
+const (
+	futexWait = 0
+	futexWake = 1
+)
+
+// shmRegion is a shared memory mapping.
+type shmRegion []byte
+
+func (r shmRegion) u32(off int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&r[off]))
+}
+
+func (r shmRegion) u64(off int) *uint64 {
+	return (*uint64)(unsafe.Pointer(&r[off]))
+}
+
+func (r shmRegion) event(off int) shmEvent {
+	return shmEvent{seq: r.u32(off), waiters: r.u32(off + 4)}
+}
+
+// shmEvent is used to wait for, and to signal, changes to shared memory.
+// Waiters sleep on seq, which is incremented each time the event is
+// signaled. The number of waiters is tracked so signaling an event that
+// no one is waiting on does not require a system call.
+type shmEvent struct {
+	seq     *uint32
+	waiters *uint32
+}
+
+// signal wakes up the waiters in all processes.
+func (e shmEvent) signal() {
+	atomic.AddUint32(e.seq, 1)
+	if atomic.LoadUint32(e.waiters) > 0 {
+		syscall.Syscall6(
+			syscall.SYS_FUTEX, uintptr(unsafe.Pointer(e.seq)),
+			futexWake, math.MaxInt32, 0, 0, 0)
+	}
+}
+
+// wait calls check until it returns true or an error, waiting for the
+// event to be signaled between calls. Each wait lasts at most the
+// duration returned by timeout, if timeout is not nil, and at most
+// shmPollInterval.
+func (e shmEvent) wait(
+	check func() (bool, error), timeout func() time.Duration) error {
+
+	registered := false
+	defer func() {
+		if registered {
+			atomic.AddUint32(e.waiters, ^uint32(0))
+		}
+	}()
+	for {
+		seq := atomic.LoadUint32(e.seq)
+		if ok, err := check(); ok || err != nil {
+			return err
+		}
+
+		// Check again once registered as a waiter, since a signal sent
+		// before registering does not wake this goroutine.
+		if !registered {
+			registered = true
+			atomic.AddUint32(e.waiters, 1)
+			continue
+		}
+
+		d := shmPollInterval
+		if timeout != nil {
+			if t := timeout(); t < d {
+				d = t
+			}
+		}
+		if d <= 0 {
+			continue
+		}
+		ts := syscall.NsecToTimespec(int64(d))
+		syscall.Syscall6(
+			syscall.SYS_FUTEX, uintptr(unsafe.Pointer(e.seq)),
+			futexWait, uintptr(seq), uintptr(unsafe.Pointer(&ts)), 0, 0)
+	}
+}
+
+// shmDirectory returns the directory that contains the shared memory
+// files. If /dev/shm does not exist then the temporary directory is
+// used, which works as long as it is not on a network file system.
+func shmDirectory() string {
+	if fi, err := os.Stat("/dev/shm"); err == nil && fi.IsDir() {
+		return "/dev/shm"
+	}
+	return os.TempDir()
+}
+
+// shmListenerPath returns the path of the file for the listener with
+// the provided name. Names are scoped to the current user.
+func shmListenerPath(network, name string) string {
+	return filepath.Join(shmDirectory(), fmt.Sprintf(
+		"memconn.%d.%s.%s", os.Getuid(), network, url.PathEscape(name)))
+}
+
+// shmConnPath returns the path of the file for the connection with the
+// provided ID.
+func shmConnPath(id uint64) string {
+	return filepath.Join(shmDirectory(), fmt.Sprintf(
+		"memconn.%d.conn.%d.%d", os.Getuid(), id>>32, uint32(id)))
+}
+
+// shmConnSeq is used to generate the IDs of dialed connections. An ID
+// is the dialer's process ID followed by the sequence number.
+var shmConnSeq uint32
+
+func shmConnID() uint64 {
+	return uint64(os.Getpid())<<32 | uint64(atomic.AddUint32(&shmConnSeq, 1))
+}
+
+// shmCreate creates a shared memory file of the provided size and maps
+// it into memory. An error that matches os.ErrExist is returned if the
+// file already exists.
+func shmCreate(path string, size int) (shmRegion, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := f.Truncate(int64(size)); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	mem, err := syscall.Mmap(int(f.Fd()), 0, size,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return mem, nil
+}
+
+// shmOpen maps an existing shared memory file into memory. An error is
+// returned if the file is not a valid shared memory file.
+func shmOpen(path string, size int) (shmRegion, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() != int64(size) {
+		return nil, syscall.EINVAL
+	}
+	mem, err := syscall.Mmap(int(f.Fd()), 0, size,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	r := shmRegion(mem)
+	if atomic.LoadUint32(r.u32(0)) != shmMagic ||
+		atomic.LoadUint32(r.u32(4)) != shmVersion {
+		syscall.Munmap(mem)
+		return nil, syscall.EINVAL
+	}
+	return r, nil
+}
+
+// pidAlive returns a flag indicating whether or not the process with the
+// provided ID is running. A process that has exited but has not been
+// reaped by its parent is not running.
+func pidAlive(pid int) bool {
+	if pid == 0 || pid == os.Getpid() {
+		return true
+	}
+	if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+		return false
+	}
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return !os.IsNotExist(err)
+	}
+	// The state follows the command name, which is in parentheses.
+	if i := bytes.LastIndexByte(stat, ')'); i >= 0 && i+2 < len(stat) {
+		return stat[i+2] != 'Z' && stat[i+2] != 'X'
+	}
+	return true
+}
+
+// shmListener is a listener for the "shmb" and "shmu" networks.
+type shmListener struct {
+	addr Addr
+	prov *Provider
+	path string
+	mem  shmRegion
+	ev   shmEvent
+
+	// acceptMu serializes Accept and prevents the memory from being
+	// unmapped while Accept uses it
+	acceptMu sync.Mutex
+
+	closed int32
+	once   sync.Once
+}
+
+// listenShm begins listening at address on a shared memory network.
+func (p *Provider) listenShm(network, address string) (net.Listener, error) {
+	laddr := Addr{Name: address, network: network}
+	path := shmListenerPath(network, address)
+
+	mem, err := shmCreate(path, lisSize)
+	if os.IsExist(err) && shmListenerStale(path) {
+		// The listener's process exited without closing the listener.
+		os.Remove(path)
+		mem, err = shmCreate(path, lisSize)
+	}
+	if err != nil {
+		if os.IsExist(err) {
+			err = ErrAddrInUse
+		}
+		return nil, &net.OpError{
+			Addr:   laddr,
+			Source: laddr,
+			Net:    network,
+			Op:     "listen",
+			Err:    err,
+		}
+	}
+
+	atomic.StoreUint32(mem.u32(lisPID), uint32(os.Getpid()))
+	atomic.StoreUint32(mem.u32(lisVersion), shmVersion)
+	atomic.StoreUint32(mem.u32(lisMagic), shmMagic)
+
+	l := &shmListener{
+		addr: laddr,
+		prov: p,
+		path: path,
+		mem:  mem,
+		ev:   mem.event(lisSeq),
+	}
+	p.track(l, "listener", l.addr, nil)
+	return l, nil
+}
+
+// shmListenerStale returns a flag indicating whether or not the listener
+// file at path belongs to a listener that is closed or whose process is
+// no longer running.
+func shmListenerStale(path string) bool {
+	mem, err := shmOpen(path, lisSize)
+	if err != nil {
+		// The file may still be being initialized by another process.
+		return false
+	}
+	defer syscall.Munmap(mem)
+	return !shmListenerAlive(mem)
+}
+
+// shmListenerAlive returns a flag indicating whether or not the listener
+// is open and its process is running.
+func shmListenerAlive(mem shmRegion) bool {
+	return atomic.LoadUint32(mem.u32(lisClosed)) == 0 &&
+		pidAlive(int(atomic.LoadUint32(mem.u32(lisPID))))
+}
+
+func (l *shmListener) isClosed() bool {
+	return atomic.LoadInt32(&l.closed) != 0
+}
+
+// Accept implements the net.Listener Accept method.
+func (l *shmListener) Accept() (net.Conn, error) {
+	l.acceptMu.Lock()
+	defer l.acceptMu.Unlock()
+
+	for {
+		if l.isClosed() {
+			return nil, l.opErr(ErrClosed)
+		}
+
+		// Wait for a dialer to post a connection to the backlog.
+		var id uint64
+		err := l.ev.wait(func() (bool, error) {
+			if l.isClosed() {
+				return false, ErrClosed
+			}
+			tail := atomic.LoadUint64(l.mem.u64(lisTail))
+			slot := l.mem.u64(lisSlots + int(tail%shmBacklog)*8)
+			if id = atomic.LoadUint64(slot); id == 0 {
+				return false, nil
+			}
+			// The dialer that claimed the slot may have exited before
+			// advancing the head, so it is advanced on its behalf.
+			atomic.CompareAndSwapUint64(l.mem.u64(lisHead), tail, tail+1)
+			atomic.StoreUint64(slot, 0)
+			atomic.StoreUint64(l.mem.u64(lisTail), tail+1)
+			l.ev.signal()
+			return true, nil
+		}, nil)
+		if err != nil {
+			return nil, l.opErr(err)
+		}
+
+		// The dial may have been canceled, or its process may have
+		// exited, in which case the next connection is accepted instead.
+		if c := l.accept(id); c != nil {
+			return c, nil
+		}
+	}
+}
+
+// accept completes the dial of the connection with the provided ID. Nil
+// is returned if the dial was canceled or the dialer's process exited.
+func (l *shmListener) accept(id uint64) *shmConn {
+	path := shmConnPath(id)
+	mem, err := shmOpen(path, connSize)
+	os.Remove(path)
+	if err != nil {
+		return nil
+	}
+	if !pidAlive(int(atomic.LoadUint32(mem.u32(connDialPID)))) {
+		syscall.Munmap(mem)
+		return nil
+	}
+
+	atomic.StoreUint32(mem.u32(connLisPID), uint32(os.Getpid()))
+	if !atomic.CompareAndSwapUint32(
+		mem.u32(connState), connPending, connAccepted) {
+
+		syscall.Munmap(mem)
+		return nil
+	}
+	mem.event(connSeq).signal()
+
+	nameLen := atomic.LoadUint32(mem.u32(connNameLen))
+	if nameLen > shmMaxName {
+		nameLen = shmMaxName
+	}
+	raddr := Addr{
+		Name:    string(mem[connName : connName+int(nameLen)]),
+		network: l.addr.network,
+	}
+	c := newShmConn(mem, false, l.addr, raddr, l.prov)
+	c.peerPID = int(atomic.LoadUint32(mem.u32(connDialPID)))
+	return c
+}
+
+// Close implements the net.Listener Close method.
+//
+// Dials that are pending are refused. Connections that were already
+// accepted are not affected.
+func (l *shmListener) Close() error {
+	l.once.Do(func() {
+		atomic.StoreInt32(&l.closed, 1)
+		atomic.StoreUint32(l.mem.u32(lisClosed), 1)
+		l.ev.signal()
+		os.Remove(l.path)
+
+		// Wait for a pending Accept to return before removing the files
+		// of the dials that were never accepted and unmapping the
+		// memory. Dialers that are still running are refused and do not
+		// need their files, and dialers that exited cannot remove them.
+		l.acceptMu.Lock()
+		for i := 0; i < shmBacklog; i++ {
+			slot := l.mem.u64(lisSlots + i*8)
+			if id := atomic.SwapUint64(slot, 0); id != 0 {
+				os.Remove(shmConnPath(id))
+			}
+		}
+		syscall.Munmap(l.mem)
+		l.acceptMu.Unlock()
+		shmRemoveStaleConns()
+
+		l.prov.untrack(l)
+	})
+	return nil
+}
+
+// shmRemoveStaleConns removes the files of connections whose dialer's
+// process exited before the connection was posted to a listener's
+// backlog or accepted.
+func shmRemoveStaleConns() {
+	paths, _ := filepath.Glob(filepath.Join(shmDirectory(),
+		fmt.Sprintf("memconn.%d.conn.*", os.Getuid())))
+	for _, path := range paths {
+		var uid, pid, seq int
+		if _, err := fmt.Sscanf(filepath.Base(path),
+			"memconn.%d.conn.%d.%d", &uid, &pid, &seq); err != nil {
+			continue
+		}
+		if !pidAlive(pid) {
+			os.Remove(path)
+		}
+	}
+}
+
+// Addr implements the net.Listener Addr method.
+func (l *shmListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *shmListener) opErr(err error) error {
+	return &net.OpError{
+		Op:     "accept",
+		Addr:   l.addr,
+		Source: l.addr,
+		Net:    l.addr.Network(),
+		Err:    err,
+	}
+}
+
+// dialShm dials address on a shared memory network.
+func (p *Provider) dialShm(
+	ctx context.Context, network, address string) (net.Conn, error) {
+
+	laddr := Addr{
+		Name:    fmt.Sprintf("%d", time.Now().UnixNano()),
+		network: network,
+	}
+	raddr := Addr{Name: address, network: network}
+	opErr := func(err error) error {
+		return &net.OpError{
+			Addr:   raddr,
+			Source: laddr,
+			Net:    network,
+			Op:     "dial",
+			Err:    err,
+		}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	lmem, err := shmOpen(shmListenerPath(network, address), lisSize)
+	if err != nil {
+		err = ErrConnRefused
+		if shmListenedOnOtherNetwork(network, address) {
+			err = ErrWrongNetwork
+		}
+		return nil, opErr(err)
+	}
+	defer syscall.Munmap(lmem)
+	if !shmListenerAlive(lmem) {
+		return nil, opErr(ErrConnRefused)
+	}
+
+	id := shmConnID()
+	path := shmConnPath(id)
+	mem, err := shmCreate(path, connSize)
+	if err != nil {
+		return nil, opErr(err)
+	}
+	name := laddr.Name
+	if len(name) > shmMaxName {
+		name = name[:shmMaxName]
+	}
+	copy(mem[connName:], name)
+	atomic.StoreUint32(mem.u32(connNameLen), uint32(len(name)))
+	atomic.StoreUint32(mem.u32(connDialPID), uint32(os.Getpid()))
+	atomic.StoreUint32(mem.u32(connVersion), shmVersion)
+	atomic.StoreUint32(mem.u32(connMagic), shmMagic)
+
+	lev, cev := lmem.event(lisSeq), mem.event(connSeq)
+	stop := shmSignalOnDone(ctx, lev, cev)
+	err = shmEnqueue(ctx, lmem, id)
+	if err == nil {
+		err = shmWaitAccepted(ctx, lmem, mem)
+	}
+	stop()
+
+	if err != nil {
+		os.Remove(path)
+		syscall.Munmap(mem)
+		return nil, opErr(err)
+	}
+
+	c := newShmConn(mem, true, laddr, raddr, p)
+	c.peerPID = int(atomic.LoadUint32(mem.u32(connLisPID)))
+	return c, nil
+}
+
+// shmListenedOnOtherNetwork returns a flag indicating whether or not
+// there is a listener with the provided name on the other shared memory
+// network.
+func shmListenedOnOtherNetwork(network, name string) bool {
+	other := networkShmb
+	if network == networkShmb {
+		other = networkShmu
+	}
+	_, err := os.Stat(shmListenerPath(other, name))
+	return err == nil
+}
+
+// shmSignalOnDone signals the provided events when ctx is done, waking
+// up the waits that check ctx. The returned function must be called
+// before the events' memory is unmapped.
+func shmSignalOnDone(ctx context.Context, evs ...shmEvent) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			for _, ev := range evs {
+				ev.signal()
+			}
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// shmEnqueue posts the connection with the provided ID to the listener's
+// backlog, waiting for room if the backlog is full.
+//
+// A dialer claims a slot by storing its ID in the slot before advancing
+// the head, so a dialer that exits between the two steps does not leave
+// an empty slot that Accept waits on forever. A dialer that finds the
+// slot at the head already claimed advances the head on behalf of the
+// dialer that claimed it.
+func shmEnqueue(ctx context.Context, lmem shmRegion, id uint64) error {
+	head, tail := lmem.u64(lisHead), lmem.u64(lisTail)
+	ev := lmem.event(lisSeq)
+	return ev.wait(func() (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		if !shmListenerAlive(lmem) {
+			return false, ErrConnRefused
+		}
+		for {
+			// The tail is loaded first since the head is never behind
+			// the tail.
+			t := atomic.LoadUint64(tail)
+			h := atomic.LoadUint64(head)
+			if h-t >= shmBacklog {
+				return false, nil
+			}
+			slot := lmem.u64(lisSlots + int(h%shmBacklog)*8)
+			claimed := atomic.CompareAndSwapUint64(slot, 0, id)
+			atomic.CompareAndSwapUint64(head, h, h+1)
+			if claimed {
+				ev.signal()
+				return true, nil
+			}
+		}
+	}, nil)
+}
+
+// shmWaitAccepted waits for the listener to accept the connection. If
+// ctx is done or the listener is closed first then the dial is canceled.
+func shmWaitAccepted(ctx context.Context, lmem, mem shmRegion) error {
+	state := mem.u32(connState)
+	return mem.event(connSeq).wait(func() (bool, error) {
+		var err error
+		switch atomic.LoadUint32(state) {
+		case connAccepted:
+			return true, nil
+		case connPending:
+			if err = ctx.Err(); err == nil {
+				if shmListenerAlive(lmem) {
+					return false, nil
+				}
+				err = ErrConnRefused
+			}
+		default:
+			return false, ErrConnRefused
+		}
+
+		// The listener may accept the connection before the dial is
+		// canceled.
+		if atomic.CompareAndSwapUint32(state, connPending, connCanceled) {
+			return false, err
+		}
+		return false, nil
+	}, nil)
+}
+
+// shmDirection is one direction of a connection: a ring buffer and the
+// state shared by its writer and reader.
+type shmDirection struct {
+	ring       []byte
+	head, tail *uint64
+	ev         shmEvent
+	wclosed    *uint32
+	rclosed    *uint32
+}
+
+func newShmDirection(mem shmRegion, i int) shmDirection {
+	off := connDirs + i*connDirSize
+	data := connData + i*shmRingSize
+	return shmDirection{
+		ring:    mem[data : data+shmRingSize],
+		head:    mem.u64(off + dirHead),
+		tail:    mem.u64(off + dirTail),
+		ev:      mem.event(off + dirSeq),
+		wclosed: mem.u32(off + dirWClosed),
+		rclosed: mem.u32(off + dirRClosed),
+	}
+}
+
+// put copies as much of b into the ring buffer as there is room for and
+// returns the number of bytes copied. Only one goroutine may call put.
+func (d shmDirection) put(b []byte) int {
+	head := atomic.LoadUint64(d.head)
+	size := uint64(len(d.ring))
+	n := size - (head - atomic.LoadUint64(d.tail))
+	if n > uint64(len(b)) {
+		n = uint64(len(b))
+	}
+	if n == 0 {
+		return 0
+	}
+	m := copy(d.ring[head%size:], b[:n])
+	copy(d.ring, b[m:n])
+	atomic.StoreUint64(d.head, head+n)
+	d.ev.signal()
+	return int(n)
+}
+
+// get copies as much of the data in the ring buffer into b as possible
+// and returns the number of bytes copied. Only one goroutine may call
+// get.
+func (d shmDirection) get(b []byte) int {
+	tail := atomic.LoadUint64(d.tail)
+	size := uint64(len(d.ring))
+	n := atomic.LoadUint64(d.head) - tail
+	if n > uint64(len(b)) {
+		n = uint64(len(b))
+	}
+	if n == 0 {
+		return 0
+	}
+	off := tail % size
+	m := copy(b[:n], d.ring[off:])
+	copy(b[m:n], d.ring)
+	atomic.StoreUint64(d.tail, tail+n)
+	d.ev.signal()
+	return int(n)
+}
+
+// shmConn is a connection on the "shmb" or "shmu" network.
+type shmConn struct {
+	laddr Addr
+	raddr Addr
+	prov  *Provider
+
+	// mem is the connection's shared memory, rx is the direction read
+	// by this side of the connection, and tx is the direction written
+	mem shmRegion
+	rx  shmDirection
+	tx  shmDirection
+
+	// peerPID is the ID of the remote process, and gone is set once the
+	// remote process is no longer running. polled is the time at which
+	// the remote process was last checked, in Unix nanoseconds.
+	peerPID int
+	gone    int32
+	polled  int64
+
+	// readMu and writeMu serialize Read and Write operations, and
+	// prevent the memory from being unmapped while they use it
+	readMu  sync.Mutex
+	writeMu sync.Mutex
+
+	// mu guards the deadlines and prevents the memory from being
+	// unmapped while the deadlines are set
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	closed int32
+	once   sync.Once
+}
+
+func newShmConn(
+	mem shmRegion, dialer bool, laddr, raddr Addr, p *Provider) *shmConn {
+
+	c := &shmConn{
+		laddr: laddr,
+		raddr: raddr,
+		prov:  p,
+		mem:   mem,
+	}
+	if dialer {
+		c.tx, c.rx = newShmDirection(mem, 0), newShmDirection(mem, 1)
+	} else {
+		c.rx, c.tx = newShmDirection(mem, 0), newShmDirection(mem, 1)
+	}
+	p.track(c, "conn", c.laddr, &c.raddr)
+	return c
+}
+
+func (c *shmConn) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) != 0
+}
+
+// remoteGone returns a flag indicating whether or not the remote process
+// is no longer running. The process is checked at most once per
+// shmPollInterval.
+func (c *shmConn) remoteGone() bool {
+	if atomic.LoadInt32(&c.gone) != 0 {
+		return true
+	}
+	now := time.Now().UnixNano()
+	if now-atomic.LoadInt64(&c.polled) < int64(shmPollInterval) {
+		return false
+	}
+	atomic.StoreInt64(&c.polled, now)
+	if !pidAlive(c.peerPID) {
+		atomic.StoreInt32(&c.gone, 1)
+		return true
+	}
+	return false
+}
+
+// expired returns a flag indicating whether or not the deadline has
+// passed.
+func (c *shmConn) expired(d *time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !d.IsZero() && !time.Now().Before(*d)
+}
+
+// remaining returns the time remaining until the deadline.
+func (c *shmConn) remaining(d *time.Time) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d.IsZero() {
+		return shmPollInterval
+	}
+	return time.Until(*d)
+}
+
+// LocalAddr implements the net.Conn LocalAddr method.
+func (c *shmConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+// RemoteAddr implements the net.Conn RemoteAddr method.
+func (c *shmConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// Read implements the net.Conn Read method. Data written by the remote
+// side of the connection is returned even if the remote side is closed.
+func (c *shmConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if c.isClosed() {
+		return 0, c.opErr("read", ErrClosed)
+	}
+
+	var n int
+	d := c.rx
+	err := d.ev.wait(func() (bool, error) {
+		switch {
+		case c.isClosed():
+			return false, ErrClosed
+		case c.expired(&c.readDeadline):
+			return false, ErrDeadlineExceeded
+		}
+		// The remote side's data is written before it is closed, so
+		// the data is read before reporting io.EOF.
+		eof := atomic.LoadUint32(d.wclosed) != 0 || c.remoteGone()
+		if n = d.get(b); n > 0 || len(b) == 0 {
+			return true, nil
+		}
+		if eof {
+			return false, io.EOF
+		}
+		return false, nil
+	}, func() time.Duration { return c.remaining(&c.readDeadline) })
+
+	if err != nil && err != io.EOF {
+		err = c.opErr("read", err)
+	}
+	return n, err
+}
+
+// Write implements the net.Conn Write method.
+//
+// On the "shmb" network Write returns once b is copied into shared
+// memory, blocking only while the remote side's ring buffer is full. On
+// the "shmu" network Write also waits for the remote side to read b.
+func (c *shmConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.isClosed() {
+		return 0, c.opErr("write", ErrClosed)
+	}
+
+	var n int
+	d := c.tx
+	start := atomic.LoadUint64(d.head)
+	end := start + uint64(len(b))
+	buffered := c.laddr.Buffered()
+
+	// The remote side may read the data and close the connection before
+	// this side observes that the data was read, so the write is checked
+	// for completion before the remote side is checked for closure.
+	written := func() bool {
+		return n == len(b) && (buffered || atomic.LoadUint64(d.tail) >= end)
+	}
+	err := d.ev.wait(func() (bool, error) {
+		switch {
+		case c.isClosed():
+			return false, ErrClosed
+		case written():
+			return true, nil
+		case atomic.LoadUint32(d.rclosed) != 0 || c.remoteGone():
+			return false, io.ErrClosedPipe
+		case c.expired(&c.writeDeadline):
+			return false, ErrDeadlineExceeded
+		}
+		for n < len(b) {
+			m := d.put(b[n:])
+			if m == 0 {
+				return false, nil
+			}
+			n += m
+		}
+		return written(), nil
+	}, func() time.Duration { return c.remaining(&c.writeDeadline) })
+
+	if err != nil {
+		// Unbuffered writes only count the data that was read.
+		if !buffered {
+			if read := int(atomic.LoadUint64(d.tail) - start); read < n {
+				n = read
+			}
+		}
+		return n, c.opErr("write", err)
+	}
+	return n, nil
+}
+
+// Close implements the net.Conn Close method. Data that was written but
+// not yet read may still be read by the remote side of the connection.
+func (c *shmConn) Close() error {
+	c.once.Do(func() {
+		c.mu.Lock()
+		atomic.StoreInt32(&c.closed, 1)
+		atomic.StoreUint32(c.tx.wclosed, 1)
+		atomic.StoreUint32(c.rx.rclosed, 1)
+		c.tx.ev.signal()
+		c.rx.ev.signal()
+		c.mu.Unlock()
+
+		// Wait for pending operations to return before unmapping the
+		// memory.
+		c.readMu.Lock()
+		c.writeMu.Lock()
+		c.mu.Lock()
+		syscall.Munmap(c.mem)
+		c.mu.Unlock()
+		c.writeMu.Unlock()
+		c.readMu.Unlock()
+
+		c.prov.untrack(c)
+	})
+	return nil
+}
+
+// SetDeadline implements the net.Conn SetDeadline method.
+func (c *shmConn) SetDeadline(t time.Time) error {
+	return c.setDeadline("setDeadline", t, true, true)
+}
+
+// SetReadDeadline implements the net.Conn SetReadDeadline method.
+func (c *shmConn) SetReadDeadline(t time.Time) error {
+	return c.setDeadline("setReadDeadline", t, true, false)
+}
+
+// SetWriteDeadline implements the net.Conn SetWriteDeadline method.
+func (c *shmConn) SetWriteDeadline(t time.Time) error {
+	return c.setDeadline("setWriteDeadline", t, false, true)
+}
+
+// setDeadline sets the read and/or write deadlines and wakes up the
+// pending operations so they observe the new deadlines.
+func (c *shmConn) setDeadline(op string, t time.Time, read, write bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err error
+	switch {
+	case c.isClosed():
+		err = ErrClosed
+	case atomic.LoadUint32(c.rx.wclosed) != 0:
+		err = io.ErrClosedPipe
+	}
+	if err != nil {
+		return &net.OpError{
+			Op:     op,
+			Addr:   c.laddr,
+			Source: c.laddr,
+			Net:    c.laddr.Network(),
+			Err:    err,
+		}
+	}
+
+	if read {
+		c.readDeadline = t
+		c.rx.ev.signal()
+	}
+	if write {
+		c.writeDeadline = t
+		c.tx.ev.signal()
+	}
+	return nil
+}
+
+// opErr wraps err as a *net.OpError with the connection's address
+// information.
+func (c *shmConn) opErr(op string, err error) error {
+	return &net.OpError{
+		Op:     op,
+		Addr:   c.raddr,
+		Source: c.laddr,
+		Net:    c.raddr.Network(),
+		Err:    err,
+	}
+}
@@ -0,0 +1,334 @@
+package memconn_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/akutz/memconn"
+	"github.com/akutz/memconn/memconntest"
+)
+
+// shmHelperEnv is the environment variable that tells the test binary
+// to act as the helper process used by the cross-process tests.
+const shmHelperEnv = "MEMCONN_SHM_HELPER"
+
+// shmNames is used to generate unique listener names.
+var shmNames uint32
+
+func shmName(t *testing.T) string {
+	return fmt.Sprintf("%s-%d-%d",
+		t.Name(), os.Getpid(), atomic.AddUint32(&shmNames, 1))
+}
+
+func TestShmConnShmb(t *testing.T) {
+	memconntest.TestConn(t, makeShmPipe(t, "shmb"))
+}
+
+func TestShmConnShmu(t *testing.T) {
+	memconntest.TestConn(t, makeShmPipe(t, "shmu"))
+}
+
+func makeShmPipe(t *testing.T, network string) memconntest.MakePipe {
+	return func() (c1, c2 net.Conn, stop func(), err error) {
+		p := &memconn.Provider{}
+		lis, err := p.Listen(network, shmName(t))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		defer lis.Close()
+
+		errs := make(chan error, 1)
+		go func() {
+			var err error
+			c2, err = lis.Accept()
+			errs <- err
+		}()
+		if c1, err = p.Dial(network, lis.Addr().String()); err != nil {
+			return nil, nil, nil, err
+		}
+		if err := <-errs; err != nil {
+			c1.Close()
+			return nil, nil, nil, err
+		}
+		return c1, c2, func() { p.Close() }, nil
+	}
+}
+
+// TestShmHelperProcess is not a real test. It is run in a separate
+// process by the cross-process tests.
+func TestShmHelperProcess(t *testing.T) {
+	args := strings.SplitN(os.Getenv(shmHelperEnv), ":", 3)
+	if len(args) != 3 {
+		return
+	}
+	if err := shmHelper(args[0], args[1], args[2]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func shmHelper(mode, network, name string) error {
+	switch mode {
+	case "echo":
+		c, err := memconn.Dial(network, name)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		_, err = io.Copy(c, c)
+		return err
+	case "exit":
+		// Exit without closing the connection.
+		c, err := memconn.Dial(network, name)
+		if err != nil {
+			return err
+		}
+		_, err = c.Write([]byte("bye"))
+		return err
+	case "abandon":
+		// Exit while the dial is waiting to be accepted.
+		go memconn.Dial(network, name)
+		time.Sleep(100 * time.Millisecond)
+		fmt.Println("dialing")
+		return nil
+	case "listen":
+		// Exit without closing the listener once it is announced.
+		if _, err := memconn.Listen(network, name); err != nil {
+			return err
+		}
+		fmt.Println("listening")
+		return nil
+	}
+	return fmt.Errorf("invalid mode: %s", mode)
+}
+
+// startShmHelper starts the helper process.
+func startShmHelper(
+	t *testing.T, mode, network, name string) (*exec.Cmd, *bufio.Reader) {
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestShmHelperProcess$")
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%s:%s:%s", shmHelperEnv, mode, network, name))
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd, bufio.NewReader(stdout)
+}
+
+// TestShmCrossProcess validates that a connection dialed by another
+// process transfers data in both directions.
+func TestShmCrossProcess(t *testing.T) {
+	for _, network := range []string{"shmb", "shmu"} {
+		t.Run(network, func(t *testing.T) {
+			p := &memconn.Provider{}
+			defer p.VerifyNoLeaks(t)
+			lis, err := p.Listen(network, shmName(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lis.Close()
+
+			cmd, _ := startShmHelper(t, "echo", network, lis.Addr().String())
+			c, err := lis.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if c.LocalAddr().Network() != network {
+				t.Fatalf("invalid network: exp=%s act=%s",
+					network, c.LocalAddr().Network())
+			}
+
+			// Write more than the capacity of the ring buffers so both
+			// processes wait on each other.
+			data := make([]byte, 1024*1024)
+			for i := range data {
+				data[i] = byte(i % 251)
+			}
+			go func() {
+				c.Write(data)
+			}()
+			buf := make([]byte, len(data))
+			if _, err := io.ReadFull(c, buf); err != nil {
+				t.Fatal(err)
+			}
+			for i := range buf {
+				if buf[i] != data[i] {
+					t.Fatalf("invalid data at %d", i)
+				}
+			}
+
+			c.Close()
+			if err := cmd.Wait(); err != nil {
+				t.Fatalf("helper failed: %v", err)
+			}
+		})
+	}
+}
+
+// TestShmRemoteExit validates that the data written by a process that
+// exits without closing its connection is read before io.EOF.
+func TestShmRemoteExit(t *testing.T) {
+	lis, err := memconn.Listen("shmb", shmName(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	cmd, _ := startShmHelper(t, "exit", "shmb", lis.Addr().String())
+	c, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("helper failed: %v", err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "bye" {
+		t.Fatalf("invalid data: %q", buf)
+	}
+	if _, err := c.Write([]byte("x")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("expected closed pipe error: %v", err)
+	}
+}
+
+// TestShmStaleListener validates that the name of a listener whose
+// process exited without closing it may be listened on again.
+func TestShmStaleListener(t *testing.T) {
+	name := shmName(t)
+	cmd, out := startShmHelper(t, "listen", "shmu", name)
+	if line, _ := out.ReadString('\n'); line != "listening\n" {
+		t.Fatalf("helper did not listen: %q", line)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("helper failed: %v", err)
+	}
+
+	if _, err := memconn.Dial("shmu", name); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("expected connection refused error: %v", err)
+	}
+	lis, err := memconn.Listen("shmu", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis.Close()
+}
+
+func TestShmErrors(t *testing.T) {
+	name := shmName(t)
+	lis, err := memconn.Listen("shmb", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	if _, err := memconn.Listen("shmb", name); !errors.Is(err, memconn.ErrAddrInUse) {
+		t.Fatalf("expected address in use error: %v", err)
+	}
+	if _, err := memconn.Dial("shmu", name); !errors.Is(err, memconn.ErrWrongNetwork) {
+		t.Fatalf("expected wrong network error: %v", err)
+	}
+	if _, err := memconn.Dial("shmb", shmName(t)); !errors.Is(err, memconn.ErrConnRefused) {
+		t.Fatalf("expected connection refused error: %v", err)
+	}
+
+	// A dial that is never accepted fails once its context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := memconn.DialContext(ctx, "shmb", name); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context error: %v", err)
+	}
+
+	// A dial that is pending when the listener is closed is refused.
+	errs := make(chan error, 1)
+	go func() {
+		_, err := memconn.Dial("shmb", name)
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	lis.Close()
+	if err := <-errs; !errors.Is(err, memconn.ErrConnRefused) {
+		t.Fatalf("expected connection refused error: %v", err)
+	}
+	if _, err := lis.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected closed error: %v", err)
+	}
+}
+
+// TestShmAbandonedDial validates that Accept skips the dials of processes
+// that exited before the dials were accepted, and that closing the
+// listener removes the files of those dials.
+func TestShmAbandonedDial(t *testing.T) {
+	lis, err := memconn.Listen("shmu", shmName(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	abandon := func() int {
+		cmd, out := startShmHelper(t, "abandon", "shmu", lis.Addr().String())
+		if line, _ := out.ReadString('\n'); line != "dialing\n" {
+			t.Fatalf("helper did not dial: %q", line)
+		}
+		if err := cmd.Wait(); err != nil {
+			t.Fatalf("helper failed: %v", err)
+		}
+		return cmd.Process.Pid
+	}
+	connFiles := func(pid int) []string {
+		paths, _ := filepath.Glob(fmt.Sprintf(
+			"/dev/shm/memconn.%d.conn.%d.*", os.Getuid(), pid))
+		return paths
+	}
+
+	abandon()
+	go func() {
+		if c, err := memconn.Dial("shmu", lis.Addr().String()); err == nil {
+			defer c.Close()
+			c.Write([]byte("live"))
+		}
+	}()
+	c, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatalf("accepted the abandoned dial: %v", err)
+	}
+
+	pid := abandon()
+	if len(connFiles(pid)) == 0 {
+		t.Skip("shared memory files are not in /dev/shm")
+	}
+	lis.Close()
+	if paths := connFiles(pid); len(paths) != 0 {
+		t.Fatalf("files of abandoned dials remain: %v", paths)
+	}
+}
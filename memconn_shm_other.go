@@ -0,0 +1,34 @@
+//go:build !linux
+
+package memconn
+
+import (
+	"context"
+	"net"
+)
+
+// listenShm fails since the shared memory networks are only supported
+// on Linux.
+func (p *Provider) listenShm(network, address string) (net.Listener, error) {
+	laddr := Addr{Name: address, network: network}
+	return nil, &net.OpError{
+		Addr:   laddr,
+		Source: laddr,
+		Net:    network,
+		Op:     "listen",
+		Err:    net.UnknownNetworkError(network),
+	}
+}
+
+// dialShm fails since the shared memory networks are only supported on
+// Linux.
+func (p *Provider) dialShm(
+	ctx context.Context, network, address string) (net.Conn, error) {
+
+	return nil, &net.OpError{
+		Addr: Addr{Name: address, network: network},
+		Net:  network,
+		Op:   "dial",
+		Err:  net.UnknownNetworkError(network),
+	}
+}
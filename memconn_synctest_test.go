@@ -0,0 +1,152 @@
+//go:build go1.25
+
+package memconn_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/akutz/memconn"
+)
+
+// TestSynctestDeadline validates that deadlines use the fake time of a
+// synctest bubble.
+func TestSynctestDeadline(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		p := &memconn.Provider{}
+		lis, err := p.ListenMem("memu", &memconn.Addr{Name: t.Name()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lis.Close()
+		client, err := p.DialMem("memu", nil, &memconn.Addr{Name: t.Name()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		start := time.Now()
+		client.SetReadDeadline(start.Add(time.Hour))
+		_, err = client.Read(make([]byte, 1))
+		if opErr, ok := err.(*net.OpError); !ok || !opErr.Timeout() {
+			t.Fatalf("read timeout should have occurred: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed != time.Hour {
+			t.Fatalf("elapsed: exp=%v act=%v", time.Hour, elapsed)
+		}
+	})
+}
+
+// TestSynctestBuffered validates that buffered connections become idle
+// once their queued writes are delivered, and that no goroutines outlive
+// the connections.
+func TestSynctestBuffered(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		p := &memconn.Provider{}
+		lis, err := p.ListenMem("memb", &memconn.Addr{Name: t.Name()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lis.Close()
+		client, err := p.DialMem("memb", nil, &memconn.Addr{Name: t.Name()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := lis.AcceptMemConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.SetReadBuffer(1024); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 100; i++ {
+			if _, err := client.Write(fixedData); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Once the bubble is idle all of the writes have been
+		// delivered to the server's receive buffer, so Flush returns
+		// without blocking.
+		synctest.Wait()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := client.Flush(ctx); err != nil {
+			t.Fatalf("flush failed: %v", err)
+		}
+
+		// Closing the client with pending data waits on the close
+		// timeout using the bubble's fake time.
+		client.SetCloseTimeout(time.Minute)
+		server.SetReadBuffer(0)
+		if _, err := client.Write(make([]byte, 2048)); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		client.Close()
+		if elapsed := time.Since(start); elapsed != time.Minute {
+			t.Fatalf("elapsed: exp=%v act=%v", time.Minute, elapsed)
+		}
+
+		n, err := io.Copy(io.Discard, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := int64(100 * len(fixedData)); n < exp {
+			t.Fatalf("read: exp>=%d act=%d", exp, n)
+		}
+		server.Close()
+	})
+}
+
+// TestSynctestListener validates that a listener does not start any
+// goroutines, so an unclosed listener does not leak from a bubble.
+func TestSynctestListener(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		p := &memconn.Provider{}
+		if _, err := p.ListenMem(
+			"memu", &memconn.Addr{Name: t.Name()}); err != nil {
+			t.Fatal(err)
+		}
+		synctest.Wait()
+	})
+}
+
+// TestSynctestShutdown validates that Listener.Shutdown waits for the
+// accepted connections using the bubble's fake time.
+func TestSynctestShutdown(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		p := &memconn.Provider{}
+		lis, err := p.ListenMem("memu", &memconn.Addr{Name: t.Name()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := p.DialMem("memu", nil, &memconn.Addr{Name: t.Name()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		server, err := lis.AcceptMemConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			time.Sleep(time.Second)
+			server.Close()
+		}()
+
+		start := time.Now()
+		if err := lis.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed != time.Second {
+			t.Fatalf("elapsed: exp=%v act=%v", time.Second, elapsed)
+		}
+	})
+}
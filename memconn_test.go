@@ -2,6 +2,8 @@ package memconn_test
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -295,13 +297,7 @@ func serve(
 				buf := make([]byte, dataLen)
 				_, err := c.Read(buf)
 				if err != nil {
-					fatal := true
-					if e, ok := err.(*net.OpError); ok {
-						if e.Err == io.EOF || e.Err == io.ErrClosedPipe {
-							fatal = false
-						}
-					}
-					if fatal {
+					if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
 						logger.Fatal(err)
 					}
 				}
@@ -367,3 +363,526 @@ func writeAndReadTestData(
 		logger.Fatalf("read != write: rbuf=%v, wbuf=%v", rbytes, wbuf)
 	}
 }
+
+// TestListenerShutdown validates that Shutdown refuses new dials and
+// waits for the accepted connections to be closed.
+func TestListenerShutdown(t *testing.T) {
+	p := &memconn.Provider{}
+	lis, err := p.ListenMem("memu", &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := p.DialMem("memu", nil, &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	server, err := lis.AcceptMemConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- lis.Shutdown(context.Background()) }()
+
+	// Shutdown must not return while the accepted connection is open.
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("shutdown returned early: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// New dials must be refused.
+	if _, err := p.DialMem(
+		"memu", nil, &memconn.Addr{Name: t.Name()}); err == nil {
+		t.Fatal("dial should have been refused")
+	}
+
+	server.Close()
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+}
+
+// TestListenerShutdownTimeout validates that Shutdown forcibly closes
+// the accepted connections once its context expires.
+func TestListenerShutdownTimeout(t *testing.T) {
+	p := &memconn.Provider{}
+	lis, err := p.ListenMem("memb", &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := p.DialMem("memb", nil, &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err := lis.AcceptMemConn(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := lis.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown should have timed out: %v", err)
+	}
+
+	// The client should observe the server side as closed.
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read should have failed")
+	}
+}
+
+// TestMembAsyncWriteErr validates that the first error that occurs as the
+// result of an asynchronous write is returned from the next Write and
+// from Close, and is sent to the channel returned by Errs without
+// blocking.
+func TestMembAsyncWriteErr(t *testing.T) {
+	p := &memconn.Provider{}
+	lis, err := p.ListenMem("memb", &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	client, err := p.DialMem("memb", nil, &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := lis.AcceptMemConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Close the server so the client's asynchronous write fails.
+	server.Close()
+	if _, err := client.Write(fixedData); err != nil {
+		t.Fatalf("buffered write should not fail synchronously: %v", err)
+	}
+
+	asyncErr := <-client.Errs()
+	if asyncErr == nil {
+		t.Fatal("expected an asynchronous write error")
+	}
+	if _, err := client.Write(fixedData); err != asyncErr {
+		t.Fatalf("write err: exp=%v act=%v", asyncErr, err)
+	}
+	if err := client.Close(); err != asyncErr {
+		t.Fatalf("close err: exp=%v act=%v", asyncErr, err)
+	}
+}
+
+// TestMembFlush validates that Flush blocks until the buffered data has
+// been read by the remote side of the connection.
+func TestMembFlush(t *testing.T) {
+	p := &memconn.Provider{}
+	lis, err := p.ListenMem("memb", &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	client, err := p.DialMem("memb", nil, &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := lis.AcceptMemConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	if _, err := client.Write(fixedData); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server is not reading so the flush should time out.
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := client.Flush(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("flush should have timed out: %v", err)
+	}
+
+	go io.CopyN(ioutil.Discard, server, dataLen)
+	if err := client.Flush(context.Background()); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+}
+
+// TestMemuReadBuffer validates that writes to a connection whose remote
+// side has a receive buffer do not block until the buffer is full.
+func TestMemuReadBuffer(t *testing.T) {
+	testReadBuffer(t, "memu", 0, 16)
+}
+
+// TestMembReadBuffer validates that a slow reader stalls a buffered
+// writer once the combined window is full.
+func TestMembReadBuffer(t *testing.T) {
+	testReadBuffer(t, "memb", 8, 16)
+}
+
+func testReadBuffer(t *testing.T, network string, wbuf, rbuf int) {
+	p := &memconn.Provider{}
+	lis, err := p.ListenMem(network, &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	client, err := p.DialMem(network, nil, &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := lis.AcceptMemConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	if err := client.SetWriteBuffer(wbuf); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetReadBuffer(rbuf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write until the window is full and the write times out.
+	client.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	written := 0
+	for {
+		n, err := client.Write(fixedData)
+		written += n
+		if err == nil {
+			continue
+		}
+		if opErr, ok := err.(*net.OpError); !ok || !opErr.Timeout() {
+			t.Fatalf("write timeout should have occurred: %v", err)
+		}
+		break
+	}
+	if exp := wbuf + rbuf; written != exp {
+		t.Fatalf("window: exp=%d act=%d", exp, written)
+	}
+
+	// Reading from the server reopens the window.
+	if _, err := io.ReadFull(server, make([]byte, rbuf)); err != nil {
+		t.Fatal(err)
+	}
+	client.SetWriteDeadline(time.Time{})
+	if _, err := client.Write(fixedData); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestConnCopy validates the io.ReaderFrom and io.WriterTo fast paths
+// between two memconn connections with and without receive buffers.
+func TestConnCopy(t *testing.T) {
+	for _, network := range []string{"memb", "memu"} {
+		for _, rbuf := range []int{0, 64} {
+			network, rbuf := network, rbuf
+			t.Run(fmt.Sprintf("%s-%d", network, rbuf), func(t *testing.T) {
+				testConnCopy(t, network, rbuf)
+			})
+		}
+	}
+}
+
+func testConnCopy(t *testing.T, network string, rbuf int) {
+	p := &memconn.Provider{}
+	pair := func(name string) (*memconn.Conn, *memconn.Conn) {
+		lis, err := p.ListenMem(network, &memconn.Addr{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lis.Close()
+		client, err := p.DialMem(network, nil, &memconn.Addr{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := lis.AcceptMemConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SetCloseTimeout(time.Minute)
+		server.SetCloseTimeout(time.Minute)
+		if err := server.SetReadBuffer(rbuf); err != nil {
+			t.Fatal(err)
+		}
+		return client, server
+	}
+
+	// Data flows from src to proxy, from proxy to dst, and is read by
+	// the sink.
+	src, proxy := pair("in")
+	dst, sink := pair("out")
+	defer sink.Close()
+
+	wbuf := make([]byte, 1024*1024)
+	rand.Read(wbuf)
+
+	go func() {
+		defer src.Close()
+		if n, err := src.ReadFrom(bytes.NewReader(wbuf)); err != nil {
+			t.Errorf("ReadFrom failed: %v", err)
+		} else if n != int64(len(wbuf)) {
+			t.Errorf("ReadFrom: exp=%d act=%d", len(wbuf), n)
+		}
+	}()
+
+	go func() {
+		defer dst.Close()
+		defer proxy.Close()
+		if n, err := io.Copy(dst, proxy); err != nil {
+			t.Errorf("proxy failed: %v", err)
+		} else if n != int64(len(wbuf)) {
+			t.Errorf("proxy: exp=%d act=%d", len(wbuf), n)
+		}
+	}()
+
+	rbytes := &bytes.Buffer{}
+	if _, err := sink.WriteTo(rbytes); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rbytes.Bytes(), wbuf) {
+		t.Fatal("read != write")
+	}
+}
+
+// TestConnWriteToDeadline validates that WriteTo honors the
+// connection's read deadline.
+func TestConnWriteToDeadline(t *testing.T) {
+	p := &memconn.Provider{}
+	lis, err := p.ListenMem("memu", &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	conn, err := p.DialMem("memu", nil, &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = conn.WriteTo(ioutil.Discard)
+	if opErr, ok := err.(*net.OpError); !ok || !opErr.Timeout() {
+		t.Fatalf("read timeout should have occurred: %v", err)
+	}
+}
+
+// TestConnReadFromDeadline validates that ReadFrom honors the
+// connection's write deadline when the source is a *Conn.
+func TestConnReadFromDeadline(t *testing.T) {
+	p := &memconn.Provider{}
+	defer p.Close()
+	pair := func(name string) (*memconn.Conn, *memconn.Conn) {
+		lis, err := p.ListenMem("memu", &memconn.Addr{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lis.Close()
+		client, err := p.DialMem("memu", nil, &memconn.Addr{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := lis.AcceptMemConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, server
+	}
+
+	// The data is available from src, but nothing reads from dst.
+	in, src := pair("in")
+	dst, _ := pair("out")
+	go in.Write([]byte("data"))
+
+	dst.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := dst.ReadFrom(src)
+	if opErr, ok := err.(*net.OpError); !ok || !opErr.Timeout() {
+		t.Fatalf("write timeout should have occurred: %v", err)
+	}
+}
+
+// TestWriteBuffers validates that the slices written with WriteBuffers
+// are not interleaved with concurrent writes.
+func TestWriteBuffers(t *testing.T) {
+	for _, network := range []string{"memb", "memu"} {
+		network := network
+		t.Run(network, func(t *testing.T) {
+			testWriteBuffers(t, network)
+		})
+	}
+}
+
+func testWriteBuffers(t *testing.T, network string) {
+	p := &memconn.Provider{}
+	lis, err := p.ListenMem(network, &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	client, err := p.DialMem(network, nil, &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetCloseTimeout(time.Minute)
+	server, err := lis.AcceptMemConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// Each writer writes frames made of a one-byte header followed by
+	// a three-byte body, all containing the writer's ID.
+	const (
+		writers = 10
+		frames  = 100
+	)
+	done := make(chan struct{})
+	for i := 0; i < writers; i++ {
+		go func(id byte) {
+			defer func() { done <- struct{}{} }()
+			for j := 0; j < frames; j++ {
+				v := net.Buffers{{id}, {id, id}, {id}}
+				if n, err := client.WriteBuffers(&v); err != nil {
+					t.Error(err)
+					return
+				} else if n != 4 || len(v) != 0 {
+					t.Errorf("WriteBuffers: n=%d len(v)=%d", n, len(v))
+					return
+				}
+			}
+		}(byte(i))
+	}
+	go func() {
+		for i := 0; i < writers; i++ {
+			<-done
+		}
+		client.Close()
+	}()
+
+	rbytes := make([]byte, writers*frames*4)
+	if _, err := io.ReadFull(server, rbytes); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(rbytes); i += 4 {
+		if f := rbytes[i : i+4]; f[0] != f[1] || f[0] != f[2] || f[0] != f[3] {
+			t.Fatalf("interleaved frame at %d: %v", i, f)
+		}
+	}
+}
+
+// TestPeerMetadata validates that metadata attached to a dial is
+// available from the accepted connection.
+func TestPeerMetadata(t *testing.T) {
+	type identity struct{ service string }
+
+	p := &memconn.Provider{}
+	lis, err := p.ListenMem("memu", &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	ctx := memconn.WithPeerMetadata(
+		context.Background(), identity{service: "frontend"})
+	client, err := p.DialMemContext(
+		ctx, "memu", nil, &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := lis.AcceptMemConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	if md, ok := server.PeerMetadata().(identity); !ok || md.service != "frontend" {
+		t.Fatalf("invalid peer metadata: %v", server.PeerMetadata())
+	}
+	if md := client.PeerMetadata(); md != nil {
+		t.Fatalf("dialed conn should not have peer metadata: %v", md)
+	}
+}
+
+// TestAdmitFunc validates that a listener's admission function can
+// refuse and delay dials.
+func TestAdmitFunc(t *testing.T) {
+	p := &memconn.Provider{}
+	lis, err := p.ListenMem("memu", &memconn.Addr{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	delay := make(chan struct{})
+	lis.SetAdmitFunc(func(
+		ctx context.Context,
+		_ *memconn.Provider,
+		laddr memconn.Addr,
+		md interface{}) error {
+
+		switch laddr.Name {
+		case "allowed":
+			return nil
+		case "delayed":
+			select {
+			case <-delay:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return fmt.Errorf("%s is not allowed", laddr.Name)
+	})
+
+	dial := func(ctx context.Context, name string) (*memconn.Conn, error) {
+		return p.DialMemContext(
+			ctx, "memu",
+			&memconn.Addr{Name: name},
+			&memconn.Addr{Name: t.Name()})
+	}
+
+	if _, err := dial(nil, "denied"); err == nil ||
+		!strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("dial should have been refused: %v", err)
+	}
+
+	client, err := dial(nil, "allowed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if server, err := lis.AcceptMemConn(); err != nil {
+		t.Fatal(err)
+	} else if name := server.RemoteAddr().String(); name != "allowed" {
+		t.Fatalf("accepted the wrong conn: %s", name)
+	}
+
+	// A delayed dial times out with the dial context's error.
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := dial(ctx, "delayed"); err == nil ||
+		err.(*net.OpError).Err != context.DeadlineExceeded {
+		t.Fatalf("dial should have timed out: %v", err)
+	}
+
+	// A delayed dial succeeds once it is admitted.
+	close(delay)
+	if client, err := dial(nil, "delayed"); err != nil {
+		t.Fatal(err)
+	} else {
+		client.Close()
+	}
+}
@@ -0,0 +1,343 @@
+package memconn
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// CertAuthority is an ephemeral certificate authority that issues TLS
+// certificates for the names of in-memory listeners and dialers. The
+// authority's key only exists in memory, so its certificates are only
+// trusted by the TLS configurations that use its CertPool.
+//
+// The certificate issued for a name has the name as its Common Name
+// and as its only DNS Subject Alternative Name, and may be used by both
+// servers and clients.
+type CertAuthority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+
+	// certs caches the certificates issued for each name
+	certs  map[string]*tls.Certificate
+	serial int64
+	mu     sync.Mutex
+}
+
+// certValidity is how long the certificates issued by a CertAuthority
+// are valid.
+const certValidity = 10 * 365 * 24 * time.Hour
+
+// NewCertAuthority returns a new CertAuthority with a newly generated
+// key and self-signed certificate.
+func NewCertAuthority() (*CertAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	notBefore := time.Now().Add(-time.Hour)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "memconn ephemeral CA"},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(certValidity),
+		KeyUsage: x509.KeyUsageCertSign |
+			x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CertAuthority{
+		cert:   cert,
+		key:    key,
+		certs:  map[string]*tls.Certificate{},
+		serial: 1,
+	}, nil
+}
+
+// CertPool returns a new pool that contains the authority's certificate.
+// Use the pool as the RootCAs or ClientCAs of a TLS configuration to
+// trust the certificates issued by the authority.
+func (ca *CertAuthority) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// Certificate returns the certificate issued for the provided name. The
+// certificate is issued the first time it is requested for the name.
+func (ca *CertAuthority) Certificate(name string) (*tls.Certificate, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if c, ok := ca.certs[name]; ok {
+		return c, nil
+	}
+	c, err := ca.issueLocked(name)
+	if err != nil {
+		return nil, err
+	}
+	ca.certs[name] = c
+	return c, nil
+}
+
+// issue returns a new certificate for the provided name without caching
+// it. It is used for names that are only used once, such as the names of
+// anonymous connections.
+func (ca *CertAuthority) issue(name string) (*tls.Certificate, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.issueLocked(name)
+}
+
+// issueLocked issues a new certificate for the provided name. The caller
+// must hold mu.
+func (ca *CertAuthority) issueLocked(name string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ca.serial++
+	notBefore := time.Now().Add(-time.Hour)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+		},
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// ServerConfig returns a TLS configuration for a listener with the
+// provided name. Client certificates issued by the authority are
+// verified if clients present them. Set the configuration's ClientAuth
+// field to tls.RequireAndVerifyClientCert to require mutual TLS.
+func (ca *CertAuthority) ServerConfig(name string) (*tls.Config, error) {
+	cert, err := ca.Certificate(name)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		ClientCAs:    ca.CertPool(),
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}, nil
+}
+
+// ClientConfig returns a TLS configuration for dialing the listener
+// with the provided server name. If clientName is not empty then the
+// configuration presents the certificate issued for clientName, which
+// the server may use to identify the client.
+func (ca *CertAuthority) ClientConfig(
+	serverName, clientName string) (*tls.Config, error) {
+
+	cfg := &tls.Config{
+		RootCAs:    ca.CertPool(),
+		ServerName: serverName,
+	}
+	if clientName != "" {
+		cert, err := ca.Certificate(clientName)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	return cfg, nil
+}
+
+// CA returns the CertAuthority used by the Provider's ListenTLS and
+// DialTLS functions. If no CertAuthority was set with SetCA then the
+// parent Provider's CertAuthority is used, and a Provider without a
+// parent generates a new CertAuthority the first time it is needed.
+func (p *Provider) CA() (*CertAuthority, error) {
+	p.tlsOpts.Lock()
+	defer p.tlsOpts.Unlock()
+	if p.tlsOpts.ca != nil {
+		return p.tlsOpts.ca, nil
+	}
+	if p.parent != nil {
+		return p.parent.CA()
+	}
+	ca, err := NewCertAuthority()
+	if err != nil {
+		return nil, err
+	}
+	p.tlsOpts.ca = ca
+	return ca, nil
+}
+
+// SetCA sets the CertAuthority used by the Provider's ListenTLS and
+// DialTLS functions. Setting the same CertAuthority on several Providers
+// allows their TLS endpoints to trust each other. Calling SetCA(nil)
+// restores the default behavior.
+func (p *Provider) SetCA(ca *CertAuthority) {
+	p.tlsOpts.Lock()
+	defer p.tlsOpts.Unlock()
+	p.tlsOpts.ca = ca
+}
+
+// SetMutualTLS enables or disables requiring clients to present a
+// certificate issued by the Provider's CertAuthority when connecting to
+// the listeners created with ListenTLS.
+//
+// While mutual TLS is enabled, the connections dialed with the
+// Provider's DialTLS functions present the certificate issued for the
+// name of their local address. Otherwise only the connections dialed
+// with an explicit local address present a certificate. The certificates
+// issued for the generated names of anonymous connections are not cached.
+//
+// Only listeners created after the call are affected.
+func (p *Provider) SetMutualTLS(enabled bool) {
+	p.tlsOpts.Lock()
+	defer p.tlsOpts.Unlock()
+	p.tlsOpts.mutual = enabled
+}
+
+// ListenTLS begins listening at address for the specified network and
+// returns a listener that wraps accepted connections in TLS. The
+// listener presents the certificate issued by the Provider's
+// CertAuthority for address.
+//
+// Known networks are "memb" (memconn buffered) and "memu" (memconn unbuffered).
+func (p *Provider) ListenTLS(network, address string) (net.Listener, error) {
+	ca, err := p.CA()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ca.ServerConfig(address)
+	if err != nil {
+		return nil, err
+	}
+	p.tlsOpts.Lock()
+	if p.tlsOpts.mutual {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	p.tlsOpts.Unlock()
+
+	l, err := p.ListenMem(network, &Addr{Name: address})
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, cfg), nil
+}
+
+// DialTLS dials a named connection and performs the TLS handshake. The
+// server's certificate is verified using the Provider's CertAuthority.
+//
+// Known networks are "memb" (memconn buffered) and "memu" (memconn unbuffered).
+func (p *Provider) DialTLS(network, address string) (*tls.Conn, error) {
+	return p.DialTLSContext(context.Background(), network, address)
+}
+
+// DialTLSContext dials a named connection and performs the TLS
+// handshake using a Go context to provide timeout behavior.
+//
+// Please see DialTLS for more information.
+func (p *Provider) DialTLSContext(
+	ctx context.Context,
+	network, address string) (*tls.Conn, error) {
+
+	return p.DialMemTLSContext(ctx, network, nil, &Addr{Name: address})
+}
+
+// DialMemTLSContext dials a named connection and performs the TLS
+// handshake using a Go context to provide timeout behavior. If laddr
+// names the connection then the connection presents the certificate
+// issued for the name of laddr, so servers that require mutual TLS can
+// identify the client by laddr. Anonymous connections only present a
+// certificate while mutual TLS is enabled. Please see SetMutualTLS for
+// more information.
+//
+// Please see DialMem for more information about laddr and raddr.
+func (p *Provider) DialMemTLSContext(
+	ctx context.Context,
+	network string,
+	laddr, raddr *Addr) (*tls.Conn, error) {
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ca, err := p.CA()
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.DialMemContext(ctx, network, laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := p.tlsClientConfig(ca, c, laddr != nil && laddr.Name != "")
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	tc := tls.Client(c, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// tlsClientConfig returns the TLS configuration for the dialed connection
+// c. A certificate is only issued for the connection if it was dialed
+// with an explicit local address, in which case the certificate is cached
+// and reused, or if mutual TLS is enabled. The certificates issued for
+// anonymous connections are not cached since their names are only used
+// once, and issuing them is avoided otherwise since generating a key for
+// every dial is expensive.
+func (p *Provider) tlsClientConfig(
+	ca *CertAuthority, c *Conn, named bool) (*tls.Config, error) {
+
+	if named {
+		return ca.ClientConfig(c.raddr.Name, c.laddr.Name)
+	}
+	cfg, err := ca.ClientConfig(c.raddr.Name, "")
+	if err != nil {
+		return nil, err
+	}
+	p.tlsOpts.Lock()
+	mutual := p.tlsOpts.mutual
+	p.tlsOpts.Unlock()
+	if mutual {
+		cert, err := ca.issue(c.laddr.Name)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,503 @@
+package memconntest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// MakePipe creates a connection between two endpoints and returns the
+// pair as c1 and c2, such that anything written to c1 is read by c2 and
+// vice-versa. The stop function closes all resources, including c1, c2,
+// and any listeners, and is called when each test completes.
+type MakePipe func() (c1, c2 net.Conn, stop func(), err error)
+
+// TestConn tests that a net.Conn implementation behaves correctly. A
+// new pair of connections is created with mp for each test. The tests
+// validate:
+//
+//   - Data is read in the order it was written, and data written by
+//     concurrent Write operations is not interleaved.
+//   - Read and Write operations fail with an error that is a timeout
+//     net.Error and matches os.ErrDeadlineExceeded once a deadline
+//     passes, including operations that are already blocked.
+//   - Operations on a closed connection fail with an error that matches
+//     net.ErrClosed or io.ErrClosedPipe, and Close unblocks them.
+//   - Reading from a connection whose peer is closed returns io.EOF.
+//   - Half-close semantics, if the connection has a CloseWrite method.
+//   - All of the net.Conn methods may be called concurrently. Run the
+//     tests with the race detector to check for data races.
+//
+// A buffered connection should be given a small write buffer and a
+// close timeout long enough for the remote side to read the pending
+// data, otherwise the tests that fill the buffer never block.
+func TestConn(t *testing.T, mp MakePipe) {
+	t.Helper()
+	t.Run("BasicIO", func(t *testing.T) { runConnTest(t, mp, testBasicIO) })
+	t.Run("PingPong", func(t *testing.T) { runConnTest(t, mp, testPingPong) })
+	t.Run("ConcurrentWrites", func(t *testing.T) { runConnTest(t, mp, testConcurrentWrites) })
+	t.Run("ConcurrentMethods", func(t *testing.T) { runConnTest(t, mp, testConcurrentMethods) })
+	t.Run("ReadTimeout", func(t *testing.T) { runConnTest(t, mp, testReadTimeout) })
+	t.Run("WriteTimeout", func(t *testing.T) { runConnTest(t, mp, testWriteTimeout) })
+	t.Run("PastTimeout", func(t *testing.T) { runConnTest(t, mp, testPastTimeout) })
+	t.Run("PresentTimeout", func(t *testing.T) { runConnTest(t, mp, testPresentTimeout) })
+	t.Run("Close", func(t *testing.T) { runConnTest(t, mp, testClose) })
+	t.Run("CloseUnblocksRead", func(t *testing.T) { runConnTest(t, mp, testCloseUnblocksRead) })
+	t.Run("CloseUnblocksWrite", func(t *testing.T) { runConnTest(t, mp, testCloseUnblocksWrite) })
+	t.Run("HalfClose", func(t *testing.T) { runConnTest(t, mp, testHalfClose) })
+}
+
+type connTester func(t *testing.T, c1, c2 net.Conn)
+
+// connTestTimeout is how long a test may run before its connections
+// are stopped to unblock it.
+const connTestTimeout = time.Minute
+
+// runConnTest creates a pair of connections and runs f with them. If
+// f does not return within connTestTimeout then the connections are
+// stopped and the test fails.
+func runConnTest(t *testing.T, mp MakePipe, f connTester) {
+	t.Helper()
+	c1, c2, stop, err := mp()
+	if err != nil {
+		t.Fatalf("unable to make pipe: %v", err)
+	}
+	var once sync.Once
+	defer once.Do(stop)
+	timer := time.AfterFunc(connTestTimeout, func() {
+		once.Do(func() {
+			t.Error("test timed out; terminating pipe")
+			stop()
+		})
+	})
+	defer timer.Stop()
+	f(t, c1, c2)
+}
+
+// testBasicIO validates that data is read in the order it is written
+// and that io.EOF is returned once the data is read and the writer is
+// closed.
+func testBasicIO(t *testing.T, c1, c2 net.Conn) {
+	want := make([]byte, 1<<20)
+	rand.New(rand.NewSource(0)).Read(want)
+
+	errc := make(chan error, 1)
+	go func() {
+		// Write the data in chunks of random sizes.
+		r := rand.New(rand.NewSource(1))
+		for b := want; len(b) > 0; {
+			n := 1 + r.Intn(32<<10)
+			if n > len(b) {
+				n = len(b)
+			}
+			if _, err := c1.Write(b[:n]); err != nil {
+				errc <- err
+				return
+			}
+			b = b[n:]
+		}
+		errc <- c1.Close()
+	}()
+
+	got, err := ioutil.ReadAll(c2)
+	if err != nil {
+		t.Errorf("unexpected Read error: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("unexpected Write or Close error: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("data mismatch: read %d bytes, wrote %d bytes",
+			len(got), len(want))
+	}
+}
+
+// testPingPong validates that each side of the connection may alternate
+// between reading and writing.
+func testPingPong(t *testing.T, c1, c2 net.Conn) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// Reply to each ping with the ping's value plus one until c1 is
+	// closed.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 8)
+		for {
+			if _, err := io.ReadFull(c2, buf); err != nil {
+				if err != io.EOF {
+					t.Errorf("unexpected ReadFull error: %v", err)
+				}
+				return
+			}
+			v := binary.LittleEndian.Uint64(buf)
+			binary.LittleEndian.PutUint64(buf, v+1)
+			if _, err := c2.Write(buf); err != nil {
+				t.Errorf("unexpected Write error: %v", err)
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 8)
+	for i := uint64(0); i < 1000; i += 2 {
+		binary.LittleEndian.PutUint64(buf, i)
+		if _, err := c1.Write(buf); err != nil {
+			t.Fatalf("unexpected Write error: %v", err)
+		}
+		if _, err := io.ReadFull(c1, buf); err != nil {
+			t.Fatalf("unexpected ReadFull error: %v", err)
+		}
+		if v := binary.LittleEndian.Uint64(buf); v != i+1 {
+			t.Fatalf("invalid pong: exp=%d act=%d", i+1, v)
+		}
+	}
+	if err := c1.Close(); err != nil {
+		t.Errorf("unexpected Close error: %v", err)
+	}
+}
+
+// testConcurrentWrites validates that the data written by a single Write
+// operation is not interleaved with the data written by concurrent
+// Write operations.
+func testConcurrentWrites(t *testing.T, c1, c2 net.Conn) {
+	const (
+		writers  = 8
+		messages = 100
+		size     = 256
+	)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// Each message begins with the writer's ID followed by the message's
+	// sequence number, and is padded with the writer's ID.
+	for id := 0; id < writers; id++ {
+		wg.Add(1)
+		go func(id byte) {
+			defer wg.Done()
+			b := bytes.Repeat([]byte{id}, size)
+			for seq := uint16(0); seq < messages; seq++ {
+				binary.LittleEndian.PutUint16(b[1:], seq)
+				if _, err := c1.Write(b); err != nil {
+					t.Errorf("unexpected Write error: %v", err)
+					return
+				}
+			}
+		}(byte(id))
+	}
+
+	var next [writers]uint16
+	b := make([]byte, size)
+	for i := 0; i < writers*messages; i++ {
+		if _, err := io.ReadFull(c2, b); err != nil {
+			t.Fatalf("unexpected ReadFull error: %v", err)
+		}
+		id := b[0]
+		if int(id) >= writers ||
+			!bytes.Equal(b[3:], bytes.Repeat([]byte{id}, size-3)) {
+			t.Fatalf("message %d is interleaved with another message", i)
+		}
+		if seq := binary.LittleEndian.Uint16(b[1:]); seq != next[id] {
+			t.Fatalf("writer %d: out of order message: exp=%d act=%d",
+				id, next[id], seq)
+		}
+		next[id]++
+	}
+}
+
+// testConcurrentMethods calls all of the net.Conn methods concurrently.
+// The results of the operations are ignored; the test is for data races
+// and deadlocks.
+func testConcurrentMethods(t *testing.T, c1, c2 net.Conn) {
+	// Echo everything written to c1 back to c1.
+	echoDone := make(chan struct{})
+	go func() {
+		defer close(echoDone)
+		io.Copy(c2, c2)
+	}()
+
+	c1.SetDeadline(time.Now().Add(10 * time.Millisecond))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(7)
+		go func() {
+			defer wg.Done()
+			c1.Read(make([]byte, 1024))
+		}()
+		go func() {
+			defer wg.Done()
+			c1.Write(make([]byte, 1024))
+		}()
+		go func() {
+			defer wg.Done()
+			c1.SetDeadline(time.Now().Add(10 * time.Millisecond))
+		}()
+		go func() {
+			defer wg.Done()
+			c1.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		}()
+		go func() {
+			defer wg.Done()
+			c1.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+		}()
+		go func() {
+			defer wg.Done()
+			c1.LocalAddr()
+		}()
+		go func() {
+			defer wg.Done()
+			c1.RemoteAddr()
+		}()
+	}
+	wg.Wait()
+
+	c1.Close()
+	c2.Close()
+	<-echoDone
+}
+
+// testReadTimeout validates that a Read operation fails once the read
+// deadline passes, and that Read operations succeed again once the
+// deadline is cleared.
+func testReadTimeout(t *testing.T, c1, c2 net.Conn) {
+	c1.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	n, err := c1.Read(make([]byte, 1024))
+	if n != 0 {
+		t.Errorf("unexpected Read count: %d", n)
+	}
+	checkTimeoutError(t, "Read", err)
+
+	c1.SetReadDeadline(time.Time{})
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c2.Write([]byte("x"))
+		errc <- err
+	}()
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(c1, buf); err != nil {
+		t.Errorf("unexpected Read error after clearing deadline: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("unexpected Write error: %v", err)
+	}
+}
+
+// testWriteTimeout validates that a Write operation fails once the write
+// deadline passes, and that Write operations succeed again once the
+// deadline is cleared.
+func testWriteTimeout(t *testing.T, c1, c2 net.Conn) {
+	c1.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	checkTimeoutError(t, "Write", writeUntilError(c1))
+
+	// Discard everything written to c1 so the writes do not block.
+	go io.Copy(ioutil.Discard, c2)
+	c1.SetWriteDeadline(time.Time{})
+	if _, err := c1.Write([]byte("x")); err != nil {
+		t.Errorf("unexpected Write error after clearing deadline: %v", err)
+	}
+}
+
+// testPastTimeout validates that Read and Write operations fail
+// immediately when the deadline has already passed.
+func testPastTimeout(t *testing.T, c1, c2 net.Conn) {
+	c1.SetDeadline(time.Now().Add(-time.Second))
+
+	n, err := c1.Read(make([]byte, 1024))
+	if n != 0 {
+		t.Errorf("unexpected Read count: %d", n)
+	}
+	checkTimeoutError(t, "Read", err)
+
+	n, err = c1.Write(make([]byte, 1024))
+	if n != 0 {
+		t.Errorf("unexpected Write count: %d", n)
+	}
+	checkTimeoutError(t, "Write", err)
+}
+
+// testPresentTimeout validates that setting a deadline to the present
+// unblocks Read and Write operations that are already blocked.
+func testPresentTimeout(t *testing.T, c1, c2 net.Conn) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		_, err := c1.Read(make([]byte, 1024))
+		checkTimeoutError(t, "Read", err)
+	}()
+	go func() {
+		defer wg.Done()
+		checkTimeoutError(t, "Write", writeUntilError(c1))
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	c1.SetDeadline(time.Now())
+}
+
+// testClose validates the behavior of both sides of a connection once
+// one side is closed.
+func testClose(t *testing.T, c1, c2 net.Conn) {
+	if err := c1.Close(); err != nil {
+		t.Errorf("unexpected Close error: %v", err)
+	}
+
+	_, err := c1.Read(make([]byte, 1024))
+	checkClosedError(t, "Read", err)
+	_, err = c1.Write(make([]byte, 1024))
+	checkClosedError(t, "Write", err)
+
+	if _, err := c2.Read(make([]byte, 1024)); err != io.EOF {
+		t.Errorf("Read from peer of closed connection: got %v; want %v",
+			err, io.EOF)
+	}
+
+	// Some implementations, such as TCP, accept the first few writes to
+	// a connection whose peer is closed.
+	for deadline := time.Now().Add(time.Second); ; {
+		if _, err := c2.Write(make([]byte, 1024)); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("Write to peer of closed connection did not fail")
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Closing a connection more than once must not panic.
+	c1.Close()
+}
+
+// testCloseUnblocksRead validates that closing a connection unblocks
+// Read operations on both sides of the connection.
+func testCloseUnblocksRead(t *testing.T, c1, c2 net.Conn) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		_, err := c1.Read(make([]byte, 1024))
+		checkClosedError(t, "Read", err)
+	}()
+	go func() {
+		defer wg.Done()
+		if _, err := c2.Read(make([]byte, 1024)); err != io.EOF {
+			t.Errorf("Read from peer of closed connection: got %v; want %v",
+				err, io.EOF)
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	if err := c1.Close(); err != nil {
+		t.Errorf("unexpected Close error: %v", err)
+	}
+}
+
+// testCloseUnblocksWrite validates that closing a connection unblocks
+// the Write operations of its peer.
+func testCloseUnblocksWrite(t *testing.T, c1, c2 net.Conn) {
+	errc := make(chan error, 1)
+	go func() { errc <- writeUntilError(c2) }()
+
+	time.Sleep(10 * time.Millisecond)
+	if err := c1.Close(); err != nil {
+		t.Errorf("unexpected Close error: %v", err)
+	}
+	if err := <-errc; err == nil {
+		t.Errorf("Write to peer of closed connection did not fail")
+	}
+}
+
+// testHalfClose validates that a connection with a CloseWrite method
+// may still read once it has stopped writing. The test is skipped for
+// connections without a CloseWrite method.
+func testHalfClose(t *testing.T, c1, c2 net.Conn) {
+	cw, ok := c1.(interface{ CloseWrite() error })
+	if !ok {
+		t.Skip("connection does not support half-close")
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		if _, err := c1.Write([]byte("ping")); err != nil {
+			errc <- err
+			return
+		}
+		errc <- cw.CloseWrite()
+	}()
+	if b, err := ioutil.ReadAll(c2); err != nil || string(b) != "ping" {
+		t.Errorf("ReadAll from half-closed peer: got %q, %v; want %q, nil",
+			b, err, "ping")
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("unexpected Write or CloseWrite error: %v", err)
+	}
+
+	if _, err := c1.Write([]byte("x")); err == nil {
+		t.Errorf("Write after CloseWrite did not fail")
+	}
+
+	go func() {
+		if _, err := c2.Write([]byte("pong")); err != nil {
+			errc <- err
+			return
+		}
+		errc <- c2.Close()
+	}()
+	if b, err := ioutil.ReadAll(c1); err != nil || string(b) != "pong" {
+		t.Errorf("ReadAll from half-closed connection: got %q, %v; want %q, nil",
+			b, err, "pong")
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("unexpected Write or Close error: %v", err)
+	}
+}
+
+// writeUntilError writes to c until a Write operation fails and returns
+// the error.
+func writeUntilError(c net.Conn) error {
+	b := make([]byte, 1024)
+	for {
+		if _, err := c.Write(b); err != nil {
+			return err
+		}
+	}
+}
+
+// checkTimeoutError fails the test if err is not a timeout error.
+func checkTimeoutError(t *testing.T, op string, err error) {
+	t.Helper()
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("%s: got %v; want timeout error", op, err)
+		return
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("%s: got %v; want error matching %v",
+			op, err, os.ErrDeadlineExceeded)
+	}
+}
+
+// checkClosedError fails the test if err does not indicate that the
+// connection is closed.
+func checkClosedError(t *testing.T, op string, err error) {
+	t.Helper()
+	if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("%s: got %v; want error matching %v or %v",
+			op, err, net.ErrClosed, io.ErrClosedPipe)
+	}
+}
@@ -0,0 +1,73 @@
+package memconntest_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/akutz/memconn"
+	"github.com/akutz/memconn/memconntest"
+)
+
+func TestConnMemb(t *testing.T) {
+	memconntest.TestConn(t, makeMemPipe("memb"))
+}
+
+func TestConnMemu(t *testing.T) {
+	memconntest.TestConn(t, makeMemPipe("memu"))
+}
+
+func TestConnPipe(t *testing.T) {
+	memconntest.TestConn(t, func() (c1, c2 net.Conn, stop func(), err error) {
+		c1, c2 = memconn.Pipe()
+		return c1, c2, func() { c1.Close(); c2.Close() }, nil
+	})
+}
+
+// TestConnTCP validates the conformance tests themselves against the
+// loopback TCP implementation.
+func TestConnTCP(t *testing.T) {
+	memconntest.TestConn(t, func() (c1, c2 net.Conn, stop func(), err error) {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		defer lis.Close()
+		if c1, err = net.Dial("tcp", lis.Addr().String()); err != nil {
+			return nil, nil, nil, err
+		}
+		if c2, err = lis.Accept(); err != nil {
+			c1.Close()
+			return nil, nil, nil, err
+		}
+		return c1, c2, func() { c1.Close(); c2.Close() }, nil
+	})
+}
+
+// makeMemPipe returns a MakePipe function that creates connections on
+// the specified network with their own Provider. Buffered connections
+// are given a small write buffer and a long close timeout.
+func makeMemPipe(network string) memconntest.MakePipe {
+	return func() (c1, c2 net.Conn, stop func(), err error) {
+		p := &memconn.Provider{}
+		lis, err := p.ListenMem(network, nil)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		defer lis.Close()
+		client, err := p.DialMem(network, nil, nil)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		server, err := lis.AcceptMemConn()
+		if err != nil {
+			client.Close()
+			return nil, nil, nil, err
+		}
+		for _, c := range []*memconn.Conn{client, server} {
+			c.SetBufferSize(4096)
+			c.SetCloseTimeout(10 * time.Second)
+		}
+		return client, server, func() { p.Close() }, nil
+	}
+}
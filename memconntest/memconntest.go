@@ -0,0 +1,102 @@
+// Package memconntest provides helpers for using memconn in tests.
+//
+// Each test gets its own isolated memconn.Provider, so parallel tests do
+// not compete for listener names. The listeners and connections created
+// by the helpers in this package are closed automatically when the test
+// completes.
+package memconntest
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/akutz/memconn"
+)
+
+// providers is the per-test Provider returned by the Provider function,
+// keyed by the test.
+var providers sync.Map
+
+// names is used to generate unique listener names.
+var names uint64
+
+// NewProvider returns a new, isolated Provider with leak tracking
+// enabled. When the test completes, the test fails if any of the
+// Provider's listeners or connections are still open, listing the stack
+// trace that created each one. All of the Provider's listeners and
+// connections are then closed so that no goroutines remain blocked on
+// them.
+//
+// Listeners and connections created with Listen and Pair are closed
+// before the Provider's check, so they never fail the test.
+func NewProvider(t testing.TB) *memconn.Provider {
+	t.Helper()
+	p := &memconn.Provider{}
+	p.SetLeakTracking(true)
+	t.Cleanup(func() {
+		p.VerifyNoLeaks(t)
+		p.Close()
+	})
+	return p
+}
+
+// Provider returns the Provider used by Listen and Pair for the test.
+// The Provider is created with NewProvider the first time this function
+// is called for the test.
+func Provider(t testing.TB) *memconn.Provider {
+	t.Helper()
+	if p, ok := providers.Load(t); ok {
+		return p.(*memconn.Provider)
+	}
+	p := NewProvider(t)
+	providers.Store(t, p)
+	t.Cleanup(func() { providers.Delete(t) })
+	return p
+}
+
+// Listen returns a new listener on the specified network with a unique
+// name. The listener is created with the test's Provider, which is also
+// used to dial it:
+//
+//	lis := memconntest.Listen(t, "memu")
+//	laddr := lis.Addr().(memconn.Addr)
+//	conn, err := memconntest.Provider(t).DialMem("memu", nil, &laddr)
+//
+// The listener is closed when the test completes.
+func Listen(t testing.TB, network string) *memconn.Listener {
+	t.Helper()
+	p := Provider(t)
+	name := fmt.Sprintf("%s-%d", t.Name(), atomic.AddUint64(&names, 1))
+	lis, err := p.ListenMem(network, &memconn.Addr{Name: name})
+	if err != nil {
+		t.Fatalf("memconntest: listen %s:%s: %v", network, name, err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	return lis
+}
+
+// Pair returns the two sides of a new connection on the specified
+// network. The client side was dialed and the server side was accepted.
+// Both sides are closed when the test completes.
+func Pair(t testing.TB, network string) (client, server *memconn.Conn) {
+	t.Helper()
+	lis := Listen(t, network)
+	defer lis.Close()
+
+	laddr := lis.Addr().(memconn.Addr)
+	client, err := Provider(t).DialMem(network, nil, &laddr)
+	if err != nil {
+		t.Fatalf("memconntest: dial %s:%s: %v", network, laddr.Name, err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	server, err = lis.AcceptMemConn()
+	if err != nil {
+		t.Fatalf("memconntest: accept %s:%s: %v", network, laddr.Name, err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	return client, server
+}
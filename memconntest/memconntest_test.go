@@ -0,0 +1,93 @@
+package memconntest_test
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/akutz/memconn"
+	"github.com/akutz/memconn/memconntest"
+)
+
+func TestPair(t *testing.T) {
+	for _, network := range []string{"memb", "memu"} {
+		network := network
+		t.Run(network, func(t *testing.T) {
+			t.Parallel()
+			client, server := memconntest.Pair(t, network)
+			go client.Write([]byte("Hello, world."))
+			buf := make([]byte, 13)
+			if _, err := io.ReadFull(server, buf); err != nil {
+				t.Fatal(err)
+			}
+			if s := string(buf); s != "Hello, world." {
+				t.Fatalf("read: %s", s)
+			}
+		})
+	}
+}
+
+func TestListen(t *testing.T) {
+	lis := memconntest.Listen(t, "memu")
+	laddr := lis.Addr().(memconn.Addr)
+	client, err := memconntest.Provider(t).DialMem("memu", nil, &laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := lis.AcceptMemConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+}
+
+// TestNewProviderLeak validates that a test fails when it does not close
+// a connection created with its Provider.
+func TestNewProviderLeak(t *testing.T) {
+	ft := &fakeTB{TB: t}
+	func() {
+		defer ft.cleanup()
+		p := memconntest.NewProvider(ft)
+		lis, err := p.ListenMem("memu", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lis.Close()
+		if _, err := p.ListenMem("memb", nil); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if len(ft.errs) != 1 {
+		t.Fatalf("errors: exp=1 act=%d", len(ft.errs))
+	}
+	if !strings.Contains(ft.errs[0], "listener memb:localhost") ||
+		!strings.Contains(ft.errs[0], "TestNewProviderLeak") {
+		t.Fatalf("invalid error: %s", ft.errs[0])
+	}
+}
+
+// fakeTB records the errors and cleanup functions of a test.
+type fakeTB struct {
+	testing.TB
+	errs     []string
+	cleanups []func()
+}
+
+func (t *fakeTB) Helper() {}
+
+func (t *fakeTB) Errorf(format string, args ...interface{}) {
+	t.errs = append(t.errs, fmt.Sprintf(format, args...))
+}
+
+func (t *fakeTB) Cleanup(f func()) {
+	t.cleanups = append(t.cleanups, f)
+}
+
+func (t *fakeTB) cleanup() {
+	for i := len(t.cleanups) - 1; i >= 0; i-- {
+		t.cleanups[i]()
+	}
+}
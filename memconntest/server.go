@@ -0,0 +1,283 @@
+package memconntest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/akutz/memconn"
+)
+
+// serverNetwork is the network used by Server.
+const serverNetwork = "memb"
+
+// Server is an HTTP server listening on an in-memory network, for use
+// in end-to-end HTTP tests. It is the equivalent of httptest.Server,
+// except no sockets are used.
+type Server struct {
+	// URL is the base URL of the form http://name or https://name,
+	// where name is the name of the server's listener.
+	URL string
+
+	// Listener is the server's listener. If the server uses TLS then
+	// the listener wraps the accepted connections in TLS.
+	Listener net.Listener
+
+	// TLS is the server's TLS configuration. It is nil if the server
+	// does not use TLS.
+	TLS *tls.Config
+
+	// Config may be changed after calling NewUnstartedServer and before
+	// calling Start or StartTLS.
+	Config *http.Server
+
+	prov   *memconn.Provider
+	name   string
+	client *http.Client
+
+	// conns tracks the server's connections and their states, and wg
+	// tracks the connections that are not yet closed or hijacked.
+	mu     sync.Mutex
+	conns  map[net.Conn]http.ConnState
+	wg     sync.WaitGroup
+	closed bool
+}
+
+// NewServer starts and returns a new Server. The caller should call
+// Close when finished, to shut it down.
+func NewServer(handler http.Handler) *Server {
+	s := NewUnstartedServer(handler)
+	s.Start()
+	return s
+}
+
+// NewTLSServer starts and returns a new Server using TLS. The server's
+// certificate is issued by an ephemeral certificate authority that is
+// trusted by the server's Client. HTTP/2 is negotiated using ALPN. The
+// caller should call Close when finished, to shut it down.
+func NewTLSServer(handler http.Handler) *Server {
+	s := NewUnstartedServer(handler)
+	s.StartTLS()
+	return s
+}
+
+// servers is used to generate unique server names.
+var servers uint64
+
+// NewUnstartedServer returns a new Server but does not start it. After
+// changing its configuration, the caller should call Start or StartTLS.
+// The caller should call Close when finished, to shut it down.
+func NewUnstartedServer(handler http.Handler) *Server {
+	return &Server{
+		Config: &http.Server{Handler: handler},
+		prov:   &memconn.Provider{},
+		name: fmt.Sprintf(
+			"memconntest-%d", atomic.AddUint64(&servers, 1)),
+	}
+}
+
+// Start starts a server from NewUnstartedServer.
+func (s *Server) Start() {
+	if s.URL != "" {
+		panic("memconntest: Server already started")
+	}
+	lis := s.listen()
+	s.Listener = lis
+	s.URL = "http://" + s.name
+
+	addr := net.JoinHostPort(s.name, "80")
+	s.client = &http.Client{Transport: &http.Transport{
+		DialContext: func(
+			ctx context.Context, network, address string) (net.Conn, error) {
+
+			if address != addr {
+				return (&net.Dialer{}).DialContext(ctx, network, address)
+			}
+			return s.prov.DialContext(ctx, serverNetwork, s.name)
+		},
+	}}
+	s.serve()
+}
+
+// StartTLS starts TLS on a server from NewUnstartedServer.
+//
+// If the server's Config.TLSConfig is set then a clone of it is used.
+// The certificate issued for the server, and the certificate authority
+// used to verify client certificates, are only added to the clone if it
+// does not set its own.
+func (s *Server) StartTLS() {
+	if s.URL != "" {
+		panic("memconntest: Server already started")
+	}
+	ca, err := s.prov.CA()
+	if err != nil {
+		panic(fmt.Sprintf("memconntest: failed to create CA: %v", err))
+	}
+
+	serverCfg, err := ca.ServerConfig(s.name)
+	if err != nil {
+		panic(fmt.Sprintf(
+			"memconntest: failed to issue certificate: %v", err))
+	}
+	if s.Config.TLSConfig != nil {
+		s.TLS = s.Config.TLSConfig.Clone()
+		if len(s.TLS.Certificates) == 0 {
+			s.TLS.Certificates = serverCfg.Certificates
+		}
+		if s.TLS.ClientCAs == nil {
+			s.TLS.ClientCAs = serverCfg.ClientCAs
+		}
+	} else {
+		s.TLS = serverCfg
+	}
+	if len(s.TLS.NextProtos) == 0 {
+		s.TLS.NextProtos = []string{"h2", "http/1.1"}
+	}
+	s.Config.TLSConfig = s.TLS
+
+	lis := s.listen()
+	s.Listener = tls.NewListener(lis, s.TLS)
+	s.URL = "https://" + s.name
+
+	clientCfg, err := ca.ClientConfig(s.name, "")
+	if err != nil {
+		panic(fmt.Sprintf(
+			"memconntest: failed to issue certificate: %v", err))
+	}
+	clientCfg.NextProtos = s.TLS.NextProtos
+
+	addr := net.JoinHostPort(s.name, "443")
+	s.client = &http.Client{Transport: &http.Transport{
+		DialTLSContext: func(
+			ctx context.Context, network, address string) (net.Conn, error) {
+
+			if address != addr {
+				return (&tls.Dialer{}).DialContext(ctx, network, address)
+			}
+			c, err := s.prov.DialContext(ctx, serverNetwork, s.name)
+			if err != nil {
+				return nil, err
+			}
+			tc := tls.Client(c, clientCfg.Clone())
+			if err := tc.HandshakeContext(ctx); err != nil {
+				c.Close()
+				return nil, err
+			}
+			return tc, nil
+		},
+		ForceAttemptHTTP2: true,
+	}}
+	s.serve()
+}
+
+// listen creates the server's in-memory listener.
+func (s *Server) listen() net.Listener {
+	lis, err := s.prov.Listen(serverNetwork, s.name)
+	if err != nil {
+		panic(fmt.Sprintf("memconntest: failed to listen: %v", err))
+	}
+	return lis
+}
+
+// serve tracks the server's connections and serves HTTP requests.
+func (s *Server) serve() {
+	s.conns = map[net.Conn]http.ConnState{}
+	connState := s.Config.ConnState
+	s.Config.ConnState = func(c net.Conn, cs http.ConnState) {
+		// The hook is called first so Close does not return before the
+		// hook observes the connections being closed.
+		if connState != nil {
+			connState(c, cs)
+		}
+		s.setState(c, cs)
+	}
+	go s.Config.Serve(s.Listener)
+}
+
+// setState records the state of a connection.
+func (s *Server) setState(c net.Conn, cs http.ConnState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch cs {
+	case http.StateNew:
+		s.wg.Add(1)
+		s.conns[c] = cs
+		if s.closed {
+			c.Close()
+		}
+	case http.StateActive, http.StateIdle:
+		if _, ok := s.conns[c]; ok {
+			s.conns[c] = cs
+			if cs == http.StateIdle && s.closed {
+				c.Close()
+			}
+		}
+	case http.StateClosed, http.StateHijacked:
+		if _, ok := s.conns[c]; ok {
+			delete(s.conns, c)
+			s.wg.Done()
+		}
+	}
+}
+
+// Close shuts down the server and blocks until all outstanding requests
+// on the server have completed. The connections that remain open, such
+// as hijacked connections, are then closed.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		s.Listener.Close()
+		s.Config.SetKeepAlivesEnabled(false)
+		for c, cs := range s.conns {
+			if cs == http.StateIdle || cs == http.StateNew {
+				c.Close()
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if t, ok := s.client.Transport.(*http.Transport); ok {
+		t.CloseIdleConnections()
+	}
+	s.wg.Wait()
+	s.prov.Close()
+}
+
+// CloseClientConnections closes any open HTTP connections to the
+// server.
+func (s *Server) CloseClientConnections() {
+	s.mu.Lock()
+	conns := make([]net.Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// Certificate returns the certificate used by the server, or nil if the
+// server does not use TLS.
+func (s *Server) Certificate() *x509.Certificate {
+	if s.TLS == nil || len(s.TLS.Certificates) == 0 {
+		return nil
+	}
+	return s.TLS.Certificates[0].Leaf
+}
+
+// Client returns an HTTP client configured for making requests to the
+// server. The client dials the server's in-memory listener for requests
+// to the server's URL, and trusts the server's certificate if the
+// server uses TLS. Requests to other hosts use the network. The client's
+// idle connections are closed when the server is closed.
+func (s *Server) Client() *http.Client {
+	return s.client
+}
@@ -0,0 +1,135 @@
+package memconntest_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/akutz/memconn/memconntest"
+)
+
+func TestServer(t *testing.T) {
+	s := memconntest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", r.Proto, r.URL.Path)
+		}))
+	defer s.Close()
+
+	if exp := "HTTP/1.1 /hello"; get(t, s, "/hello") != exp {
+		t.Fatalf("invalid response: exp=%s", exp)
+	}
+	if s.Certificate() != nil {
+		t.Fatal("expected nil certificate")
+	}
+}
+
+func TestTLSServer(t *testing.T) {
+	s := memconntest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", r.Proto, r.URL.Path)
+		}))
+	defer s.Close()
+
+	if exp := "HTTP/2.0 /hello"; get(t, s, "/hello") != exp {
+		t.Fatalf("invalid response: exp=%s", exp)
+	}
+	if c := s.Certificate(); c == nil || c.Subject.CommonName == "" {
+		t.Fatal("expected server certificate")
+	}
+}
+
+// TestTLSServerConfig validates that the server uses the TLSConfig set
+// by the caller instead of only its NextProtos.
+func TestTLSServerConfig(t *testing.T) {
+	s := memconntest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%x", r.TLS.Version)
+		}))
+	s.Config.TLSConfig = &tls.Config{MaxVersion: tls.VersionTLS12}
+	s.StartTLS()
+	defer s.Close()
+
+	if exp := fmt.Sprintf("%x", tls.VersionTLS12); get(t, s, "/") != exp {
+		t.Fatalf("invalid TLS version: exp=%s", exp)
+	}
+}
+
+// TestServerCloseHijacked validates that Close closes the connections
+// hijacked from the server.
+func TestServerCloseHijacked(t *testing.T) {
+	hijacked := make(chan net.Conn, 1)
+	s := memconntest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			c, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			hijacked <- c
+		}))
+
+	go s.Client().Get(s.URL)
+	c := <-hijacked
+	s.Close()
+	if _, err := c.Write([]byte("x")); err == nil {
+		t.Fatal("hijacked connection should have been closed")
+	}
+}
+
+func TestServerCloseClientConnections(t *testing.T) {
+	for _, useTLS := range []bool{false, true} {
+		var (
+			mu     sync.Mutex
+			closed int
+		)
+		s := memconntest.NewUnstartedServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "ok")
+			}))
+		s.Config.ConnState = func(_ net.Conn, cs http.ConnState) {
+			if cs == http.StateClosed {
+				mu.Lock()
+				closed++
+				mu.Unlock()
+			}
+		}
+		if useTLS {
+			s.StartTLS()
+		} else {
+			s.Start()
+		}
+
+		// The client dials a new connection once its connection is
+		// closed.
+		get(t, s, "/")
+		s.CloseClientConnections()
+		get(t, s, "/")
+		s.Close()
+
+		mu.Lock()
+		if closed != 2 {
+			t.Errorf("tls=%v: closed conns: exp=2 act=%d", useTLS, closed)
+		}
+		mu.Unlock()
+	}
+}
+
+// get requests the provided path from the server and returns the
+// response body.
+func get(t *testing.T, s *memconntest.Server, path string) string {
+	t.Helper()
+	rep, err := s.Client().Get(s.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rep.Body.Close()
+	buf, err := ioutil.ReadAll(rep.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
@@ -0,0 +1,455 @@
+// Package mux multiplexes independent streams over a single connection,
+// such as a *memconn.Conn. Each stream implements net.Conn and has its
+// own flow control window and deadlines, and may be reset without
+// affecting the other streams. Streams do not start goroutines, so
+// thousands of streams may be opened cheaply.
+//
+// A Session is created for each side of the connection with Client or
+// Server. Either side may open streams, and the streams opened by one
+// side are accepted by the other side.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+)
+
+var (
+	// ErrStreamReset is returned by the operations on a stream that was
+	// reset by either side of the stream. The error matches
+	// syscall.ECONNRESET when using errors.Is.
+	ErrStreamReset = fmt.Errorf("mux: stream reset: %w", syscall.ECONNRESET)
+
+	// ErrSessionShutdown is returned by the operations on a session,
+	// and on its streams, once the session is closed or its connection
+	// fails. The error matches net.ErrClosed when using errors.Is.
+	ErrSessionShutdown = fmt.Errorf("mux: session shutdown: %w", net.ErrClosed)
+
+	// errProtocol is the cause of a session shutdown due to an invalid
+	// frame.
+	errProtocol = errors.New("mux: protocol error")
+)
+
+// Config is used to configure a Session.
+type Config struct {
+	// AcceptBacklog is the maximum number of streams opened by the
+	// remote side that may be pending a call to Accept. Streams opened
+	// once the backlog is full are reset. The default is 256.
+	AcceptBacklog int
+
+	// StreamWindow is the number of bytes each stream may receive
+	// before the data is read. A writer blocks once the window of the
+	// remote side of its stream is full. The default is 256 KiB.
+	//
+	// Both sides of a session must use the same window size.
+	StreamWindow uint32
+}
+
+const (
+	defaultAcceptBacklog = 256
+	defaultStreamWindow  = 256 * 1024
+
+	// maxFrameSize is the maximum size of the payload of a data frame.
+	maxFrameSize = 16 * 1024
+
+	// maxPendingResets is the maximum number of resets that may be
+	// queued to be sent. Once the queue is full, further resets are
+	// dropped, and the remote side resends the frames that caused them.
+	maxPendingResets = 1024
+)
+
+// Frame types and flags.
+const (
+	frameData         uint8 = 0
+	frameWindowUpdate uint8 = 1
+
+	flagSYN uint16 = 1 << 0
+	flagFIN uint16 = 1 << 1
+	flagRST uint16 = 1 << 2
+)
+
+// A frame header is encoded as:
+//
+//	version(1) type(1) flags(2) stream ID(4) length(4)
+//
+// The length is the size of the payload for data frames and the window
+// increment for window update frames.
+const (
+	protoVersion uint8 = 0
+	headerSize         = 12
+)
+
+// Session multiplexes streams over a single connection. A Session
+// implements net.Listener; its Accept method returns the streams opened
+// by the remote side.
+type Session struct {
+	conn   net.Conn
+	config Config
+
+	// writeMu serializes the frames written to conn
+	writeMu sync.Mutex
+
+	// streams are the streams that may still receive frames, keyed
+	// by ID, and nextID is the ID of the next stream opened by this
+	// side of the session
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+
+	// resets are the IDs of the streams whose resets are queued to be
+	// sent, and resetting indicates whether or not the goroutine that
+	// sends them is running. Both are guarded by mu.
+	resets    []uint32
+	resetting bool
+
+	acceptCh chan *Stream
+
+	// done is closed when the session is shut down, and err is the
+	// reason for the shutdown
+	done     chan struct{}
+	doneOnce sync.Once
+	err      error
+}
+
+// Client returns the client side of a session over conn. The streams
+// opened by the client have odd IDs. If config is nil then the default
+// configuration is used.
+func Client(conn net.Conn, config *Config) *Session {
+	return newSession(conn, config, 1)
+}
+
+// Server returns the server side of a session over conn. The streams
+// opened by the server have even IDs. If config is nil then the default
+// configuration is used.
+func Server(conn net.Conn, config *Config) *Session {
+	return newSession(conn, config, 2)
+}
+
+func newSession(conn net.Conn, config *Config, firstID uint32) *Session {
+	s := &Session{
+		conn:    conn,
+		streams: map[uint32]*Stream{},
+		nextID:  firstID,
+		done:    make(chan struct{}),
+	}
+	if config != nil {
+		s.config = *config
+	}
+	if s.config.AcceptBacklog <= 0 {
+		s.config.AcceptBacklog = defaultAcceptBacklog
+	}
+	if s.config.StreamWindow == 0 {
+		s.config.StreamWindow = defaultStreamWindow
+	}
+	s.acceptCh = make(chan *Stream, s.config.AcceptBacklog)
+	go s.recvLoop()
+	return s
+}
+
+// Open opens a new stream. The remote side of the session is notified
+// of the stream immediately, but the stream may be used without waiting
+// for the remote side to accept it.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.isShutdown() {
+		s.mu.Unlock()
+		return nil, s.opErr("open", ErrSessionShutdown)
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	err := s.send(frameWindowUpdate, flagSYN, id, 0, nil, nil)
+	if err != nil {
+		return nil, s.opErr("open", err)
+	}
+	return st, nil
+}
+
+// Accept waits for and returns the next stream opened by the remote
+// side of the session.
+func (s *Session) Accept() (net.Conn, error) {
+	return s.AcceptStream()
+}
+
+// AcceptStream waits for and returns the next stream opened by the
+// remote side of the session. AcceptStream fails once the session is
+// shut down.
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case st := <-s.acceptCh:
+		// Streams pending in the backlog are not returned once the
+		// session is shut down.
+		if !s.isShutdown() {
+			return st, nil
+		}
+	case <-s.done:
+	}
+	return nil, s.opErr("accept", ErrSessionShutdown)
+}
+
+// Addr returns the local address of the session's connection.
+func (s *Session) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// NumStreams returns the number of streams that may still receive data
+// from the remote side of the session.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// Close closes the session and its connection. The pending and future
+// operations on the session's streams fail with ErrSessionShutdown.
+func (s *Session) Close() error {
+	s.shutdown(ErrSessionShutdown)
+	return nil
+}
+
+// Done returns a channel that is closed when the session is shut down.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the reason the session was shut down, or nil if the
+// session is not shut down.
+func (s *Session) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+func (s *Session) isShutdown() bool {
+	return isClosedChan(s.done)
+}
+
+// shutdown closes the session's connection and wakes up the operations
+// blocked on the session's streams.
+func (s *Session) shutdown(err error) {
+	s.doneOnce.Do(func() {
+		s.err = err
+		close(s.done)
+		s.conn.Close()
+
+		s.mu.Lock()
+		streams := s.streams
+		s.streams = map[uint32]*Stream{}
+		s.mu.Unlock()
+		for _, st := range streams {
+			st.mu.Lock()
+			st.notify()
+			st.mu.Unlock()
+		}
+	})
+}
+
+// send writes a frame to the session's connection. If the write fails
+// then the session is shut down.
+//
+// If pre is not nil then it is called once no other frame is being
+// written, and the frame is only written if pre returns true. This
+// allows the state of a stream to be updated in the same order that
+// its frames are written.
+func (s *Session) send(
+	typ uint8, flags uint16, id, length uint32, body []byte,
+	pre func() bool) error {
+
+	var hdr [headerSize]byte
+	hdr[0] = protoVersion
+	hdr[1] = typ
+	binary.BigEndian.PutUint16(hdr[2:], flags)
+	binary.BigEndian.PutUint32(hdr[4:], id)
+	binary.BigEndian.PutUint32(hdr[8:], length)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.isShutdown() {
+		return ErrSessionShutdown
+	}
+	if pre != nil && !pre() {
+		return nil
+	}
+	if _, err := s.conn.Write(hdr[:]); err != nil {
+		s.shutdown(err)
+		return ErrSessionShutdown
+	}
+	if len(body) > 0 {
+		if _, err := s.conn.Write(body); err != nil {
+			s.shutdown(err)
+			return ErrSessionShutdown
+		}
+	}
+	return nil
+}
+
+// sendReset resets the stream with the provided ID. The reset is queued
+// and sent by a single goroutine, which runs only while resets are
+// queued, so the receive loop never blocks on a write and frames from
+// the remote side cannot start a goroutine each.
+func (s *Session) sendReset(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.resets) >= maxPendingResets {
+		return
+	}
+	for _, r := range s.resets {
+		if r == id {
+			return
+		}
+	}
+	s.resets = append(s.resets, id)
+	if !s.resetting {
+		s.resetting = true
+		go s.flushResets()
+	}
+}
+
+// flushResets sends the queued resets. It is run as a goroutine and
+// returns once the queue is empty or the session is shut down.
+func (s *Session) flushResets() {
+	var ids []uint32
+	for {
+		s.mu.Lock()
+		if len(s.resets) == 0 {
+			s.resetting = false
+			s.mu.Unlock()
+			return
+		}
+		// The queue's slices are swapped so neither is reallocated.
+		ids, s.resets = s.resets, ids[:0]
+		s.mu.Unlock()
+
+		for _, id := range ids {
+			err := s.send(frameWindowUpdate, flagRST, id, 0, nil, nil)
+			if err != nil {
+				s.mu.Lock()
+				s.resets = nil
+				s.resetting = false
+				s.mu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// removeStream stops routing frames to the stream.
+func (s *Session) removeStream(st *Stream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.streams[st.id] == st {
+		delete(s.streams, st.id)
+	}
+}
+
+// recvLoop reads frames from the session's connection until the
+// connection fails. The loop never blocks on anything other than
+// reading, so writers on the remote side are never stalled by this
+// side's writers.
+func (s *Session) recvLoop() {
+	var hdr [headerSize]byte
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			s.shutdown(ErrSessionShutdown)
+			return
+		}
+		if hdr[0] != protoVersion {
+			s.shutdown(errProtocol)
+			return
+		}
+		typ := hdr[1]
+		flags := binary.BigEndian.Uint16(hdr[2:])
+		id := binary.BigEndian.Uint32(hdr[4:])
+		length := binary.BigEndian.Uint32(hdr[8:])
+
+		var body []byte
+		switch typ {
+		case frameData:
+			if length > maxFrameSize {
+				s.shutdown(errProtocol)
+				return
+			}
+			if length > 0 {
+				body = make([]byte, length)
+				if _, err := io.ReadFull(s.conn, body); err != nil {
+					s.shutdown(ErrSessionShutdown)
+					return
+				}
+			}
+		case frameWindowUpdate:
+		default:
+			s.shutdown(errProtocol)
+			return
+		}
+
+		if err := s.handleFrame(typ, flags, id, length, body); err != nil {
+			s.shutdown(err)
+			return
+		}
+	}
+}
+
+// handleFrame delivers a frame to its stream, creating the stream if
+// the frame opens it.
+func (s *Session) handleFrame(
+	typ uint8, flags uint16, id, length uint32, body []byte) error {
+
+	s.mu.Lock()
+	st := s.streams[id]
+	if flags&flagSYN != 0 {
+		// The remote side may only open streams with IDs of the other
+		// parity than the IDs of the streams opened by this side.
+		if st != nil || id == 0 || id%2 == s.nextID%2 {
+			s.mu.Unlock()
+			return errProtocol
+		}
+		st = newStream(s, id)
+		select {
+		case s.acceptCh <- st:
+			s.streams[id] = st
+		default:
+			// The backlog is full.
+			s.mu.Unlock()
+			s.sendReset(id)
+			return nil
+		}
+	}
+	s.mu.Unlock()
+
+	if st == nil {
+		// The stream is unknown or was removed. Reset it unless the
+		// frame is a reset.
+		if flags&flagRST == 0 {
+			s.sendReset(id)
+		}
+		return nil
+	}
+
+	if typ == frameWindowUpdate {
+		return st.recvWindowUpdate(flags, length)
+	}
+	return st.recvData(flags, body)
+}
+
+// opErr wraps err as a *net.OpError with the session's address
+// information.
+func (s *Session) opErr(op string, err error) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    "mux",
+		Source: s.conn.LocalAddr(),
+		Addr:   s.conn.RemoteAddr(),
+		Err:    err,
+	}
+}
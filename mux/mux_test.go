@@ -0,0 +1,330 @@
+package mux_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/akutz/memconn"
+	"github.com/akutz/memconn/memconntest"
+	"github.com/akutz/memconn/mux"
+)
+
+func TestConnMemu(t *testing.T) {
+	memconntest.TestConn(t, makePipe(t, "memu"))
+}
+
+func TestConnMemb(t *testing.T) {
+	memconntest.TestConn(t, makePipe(t, "memb"))
+}
+
+func TestConnPipe(t *testing.T) {
+	memconntest.TestConn(t, makePipe(t, ""))
+}
+
+// makePipe returns a MakePipe function that opens a stream over a new
+// session on the specified network. If the network is empty then the
+// session uses memconn.Pipe.
+func makePipe(t *testing.T, network string) memconntest.MakePipe {
+	return func() (c1, c2 net.Conn, stop func(), err error) {
+		client, server, err := newSessions(network, &mux.Config{
+			StreamWindow: 64 * 1024,
+		})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		stop = func() {
+			client.Close()
+			server.Close()
+		}
+		st1, err := client.Open()
+		if err != nil {
+			stop()
+			return nil, nil, nil, err
+		}
+		st2, err := server.AcceptStream()
+		if err != nil {
+			stop()
+			return nil, nil, nil, err
+		}
+		return st1, st2, stop, nil
+	}
+}
+
+// newSessions returns the client and server sides of a session over a
+// new connection on the specified network. If the network is empty then
+// the session uses memconn.Pipe.
+func newSessions(
+	network string, config *mux.Config) (*mux.Session, *mux.Session, error) {
+
+	if network == "" {
+		c1, c2 := memconn.Pipe()
+		return mux.Client(c1, config), mux.Server(c2, config), nil
+	}
+
+	p := &memconn.Provider{}
+	lis, err := p.ListenMem(network, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer lis.Close()
+	c1, err := p.DialMem(network, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	c2, err := lis.AcceptMemConn()
+	if err != nil {
+		c1.Close()
+		return nil, nil, err
+	}
+	return mux.Client(c1, config), mux.Server(c2, config), nil
+}
+
+// TestManyStreams validates that many streams may be used concurrently
+// over a single connection, opened from either side of the session.
+func TestManyStreams(t *testing.T) {
+	client, server, err := newSessions("memu", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	// Both sides echo the data of the streams they accept.
+	for _, s := range []*mux.Session{client, server} {
+		go func(s *mux.Session) {
+			for {
+				st, err := s.AcceptStream()
+				if err != nil {
+					return
+				}
+				go func() {
+					io.Copy(st, st)
+					st.Close()
+				}()
+			}
+		}(s)
+	}
+
+	const streams = 1000
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := client
+			if i%2 == 1 {
+				s = server
+			}
+			st, err := s.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer st.Close()
+
+			msg := fmt.Sprintf("stream %d", i)
+			if _, err := io.WriteString(st, msg); err != nil {
+				t.Error(err)
+				return
+			}
+			st.CloseWrite()
+			buf, err := io.ReadAll(st)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if string(buf) != msg {
+				t.Errorf("invalid echo: exp=%s act=%s", msg, buf)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// TestReset validates that resetting a stream fails the operations on
+// both sides of the stream without affecting other streams.
+func TestReset(t *testing.T) {
+	client, server, err := newSessions("memb", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	st1, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRemote, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := st2.Read(make([]byte, 1))
+		errc <- err
+	}()
+	if err := st1.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; !errors.Is(err, mux.ErrStreamReset) ||
+		!errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("remote read: expected reset error: %v", err)
+	}
+	if _, err := st1.Write([]byte("x")); !errors.Is(err, mux.ErrStreamReset) {
+		t.Fatalf("local write: expected reset error: %v", err)
+	}
+
+	go other.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(otherRemote, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("invalid data: %s", buf)
+	}
+}
+
+// TestSessionClose validates that closing a session fails the
+// operations on its streams and the remote session.
+func TestSessionClose(t *testing.T) {
+	client, server, err := newSessions("memu", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := st.Read(make([]byte, 1))
+		errc <- err
+	}()
+
+	client.Close()
+	if err := <-errc; !errors.Is(err, mux.ErrSessionShutdown) ||
+		!errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected session shutdown error: %v", err)
+	}
+	if _, err := client.Open(); !errors.Is(err, mux.ErrSessionShutdown) {
+		t.Fatalf("expected session shutdown error: %v", err)
+	}
+
+	// The remote session shuts down once its connection is closed.
+	<-server.Done()
+	if _, err := server.AcceptStream(); !errors.Is(err, mux.ErrSessionShutdown) {
+		t.Fatalf("expected session shutdown error: %v", err)
+	}
+}
+
+// TestAcceptBacklog validates that streams opened once the remote
+// side's accept backlog is full are reset.
+func TestAcceptBacklog(t *testing.T) {
+	client, server, err := newSessions("memb", &mux.Config{AcceptBacklog: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	if _, err := client.Open(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, mux.ErrStreamReset) {
+		t.Fatalf("expected reset error: %v", err)
+	}
+	if n := server.NumStreams(); n != 1 {
+		t.Fatalf("server streams: exp=1 act=%d", n)
+	}
+}
+
+// rawFrame encodes a frame header for a window update with the provided
+// flags and stream ID.
+func rawFrame(flags uint16, id uint32) []byte {
+	hdr := make([]byte, 12)
+	hdr[1] = 1
+	binary.BigEndian.PutUint16(hdr[2:], flags)
+	binary.BigEndian.PutUint32(hdr[4:], id)
+	return hdr
+}
+
+// TestOpenParity validates that a session is shut down when the remote
+// side opens a stream with an ID of the session's own parity.
+func TestOpenParity(t *testing.T) {
+	c1, c2 := memconn.Pipe()
+	defer c1.Close()
+	server := mux.Server(c2, nil)
+	defer server.Close()
+
+	// The server opens streams with even IDs, so the client may not.
+	go c1.Write(rawFrame(1, 2))
+	<-server.Done()
+	if err := server.Err(); err == nil || errors.Is(err, mux.ErrSessionShutdown) {
+		t.Fatalf("expected protocol error: %v", err)
+	}
+}
+
+// TestResetUnknownStreams validates that the frames sent on unknown
+// streams are reset without a reset being queued for each frame.
+func TestResetUnknownStreams(t *testing.T) {
+	c1, c2 := memconn.Pipe()
+	defer c1.Close()
+	server := mux.Server(c2, nil)
+	defer server.Close()
+
+	// The frames are written before any reset is read, so the first
+	// reset cannot be sent until then and the following resets of the
+	// same stream are coalesced while they wait to be sent.
+	for i := 0; i < 1000; i++ {
+		if _, err := c1.Write(rawFrame(0, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c1.Write(rawFrame(0, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read the resets until no more are sent.
+	resets := map[uint32]int{}
+	hdr := make([]byte, 12)
+	for {
+		c1.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := io.ReadFull(c1, hdr); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			t.Fatal(err)
+		}
+		if binary.BigEndian.Uint16(hdr[2:])&4 == 0 {
+			t.Fatalf("expected reset frame: %v", hdr)
+		}
+		resets[binary.BigEndian.Uint32(hdr[4:])]++
+	}
+	if resets[1] == 0 || resets[3] != 1 || resets[1] > 2 {
+		t.Fatalf("invalid resets: %v", resets)
+	}
+}
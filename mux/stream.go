@@ -0,0 +1,371 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a logical connection multiplexed over a Session. Stream
+// implements net.Conn.
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	// writeMu prevents the data of concurrent Write operations from
+	// being interleaved
+	writeMu sync.Mutex
+
+	// mu guards the fields below
+	mu sync.Mutex
+
+	// recv is the data received but not yet read
+	recv bytes.Buffer
+
+	// recvWindow is the number of bytes the remote side may still send,
+	// and consumed is the number of bytes read since the last window
+	// update was sent
+	recvWindow uint32
+	consumed   uint32
+
+	// sendWindow is the number of bytes this side may still send
+	sendWindow uint32
+
+	// closed is true once Close is called, finSent is true once this
+	// side stops writing, remoteFIN is true once the remote side stops
+	// writing, and reset is true once either side resets the stream
+	closed    bool
+	finSent   bool
+	remoteFIN bool
+	reset     bool
+
+	// changed is closed and replaced each time the state of the stream
+	// changes
+	changed chan struct{}
+
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:            id,
+		sess:          s,
+		recvWindow:    s.config.StreamWindow,
+		sendWindow:    s.config.StreamWindow,
+		changed:       make(chan struct{}),
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+	}
+}
+
+// notify wakes up the operations waiting on the stream to change. The
+// caller must hold mu.
+func (st *Stream) notify() {
+	close(st.changed)
+	st.changed = make(chan struct{})
+}
+
+// ID returns the stream's ID, which is unique within its session.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// LocalAddr returns the local address of the session's connection.
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the session's connection.
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.conn.RemoteAddr()
+}
+
+// Read implements the net.Conn Read method. Once the remote side of the
+// stream stops writing, Read returns the remaining data and then io.EOF.
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		var err error
+		switch {
+		case st.closed:
+			err = net.ErrClosed
+		case st.reset:
+			err = ErrStreamReset
+		case isClosedChan(st.readDeadline.wait()):
+			err = os.ErrDeadlineExceeded
+		case st.recv.Len() > 0:
+			n, _ := st.recv.Read(b)
+			delta := st.consume(n)
+			st.mu.Unlock()
+			if delta > 0 {
+				st.sess.send(frameWindowUpdate, 0, st.id, delta, nil, nil)
+			}
+			return n, nil
+		case st.remoteFIN:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.sess.isShutdown():
+			err = ErrSessionShutdown
+		case len(b) == 0:
+			st.mu.Unlock()
+			return 0, nil
+		}
+		changed := st.changed
+		st.mu.Unlock()
+
+		if err != nil {
+			return 0, st.opErr("read", err)
+		}
+		select {
+		case <-changed:
+		case <-st.readDeadline.wait():
+		}
+	}
+}
+
+// consume records that n bytes were read and returns the increment of
+// the window update to send, if any. Updates are batched until at least
+// half of the window is consumed. The caller must hold mu.
+func (st *Stream) consume(n int) uint32 {
+	st.consumed += uint32(n)
+	if st.remoteFIN || st.consumed < st.sess.config.StreamWindow/2 {
+		return 0
+	}
+	delta := st.consumed
+	st.consumed = 0
+	st.recvWindow += delta
+	return delta
+}
+
+// Write implements the net.Conn Write method. Write blocks while the
+// remote side's receive window is full.
+func (st *Stream) Write(b []byte) (int, error) {
+	st.writeMu.Lock()
+	defer st.writeMu.Unlock()
+
+	var n int
+	for {
+		st.mu.Lock()
+		var err error
+		switch {
+		case st.finSent:
+			err = net.ErrClosed
+		case st.reset:
+			err = ErrStreamReset
+		case st.sess.isShutdown():
+			err = ErrSessionShutdown
+		case isClosedChan(st.writeDeadline.wait()):
+			err = os.ErrDeadlineExceeded
+		case len(b) == 0:
+			st.mu.Unlock()
+			return n, nil
+		}
+		if err != nil {
+			st.mu.Unlock()
+			return n, st.opErr("write", err)
+		}
+		if st.sendWindow == 0 {
+			changed := st.changed
+			st.mu.Unlock()
+			select {
+			case <-changed:
+			case <-st.writeDeadline.wait():
+			}
+			continue
+		}
+		size := uint32(len(b))
+		if size > st.sendWindow {
+			size = st.sendWindow
+		}
+		if size > maxFrameSize {
+			size = maxFrameSize
+		}
+		st.sendWindow -= size
+		st.mu.Unlock()
+
+		// The data is not sent if the stream was closed or reset while
+		// the lock was released, so no data follows a FIN or RST.
+		sent := false
+		err = st.sess.send(frameData, 0, st.id, size, b[:size], func() bool {
+			st.mu.Lock()
+			defer st.mu.Unlock()
+			sent = !st.finSent && !st.reset
+			return sent
+		})
+		if err != nil {
+			return n, st.opErr("write", err)
+		}
+		if sent {
+			n += int(size)
+			b = b[size:]
+		}
+	}
+}
+
+// Close closes the stream. Pending and future Read and Write operations
+// fail with an error that matches net.ErrClosed, and the remote side
+// of the stream reads io.EOF once it has read the data that was sent.
+//
+// Like TCP, if there is unread data when the stream is closed, or data
+// arrives after the stream is closed, then the stream is reset instead.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	unread := st.recv.Len() > 0
+	st.recv.Reset()
+	st.notify()
+	st.mu.Unlock()
+
+	if unread {
+		return st.sendReset()
+	}
+	return st.sendFIN()
+}
+
+// CloseWrite shuts down the writing side of the stream. The remote side
+// of the stream reads io.EOF once it has read the data that was sent,
+// and this side may continue reading.
+func (st *Stream) CloseWrite() error {
+	return st.sendFIN()
+}
+
+// Reset resets the stream. Pending and future operations on both sides
+// of the stream fail with ErrStreamReset, and data that has not been
+// read is discarded.
+func (st *Stream) Reset() error {
+	return st.sendReset()
+}
+
+// sendFIN tells the remote side that this side will not send more data.
+func (st *Stream) sendFIN() error {
+	var done bool
+	err := st.sess.send(frameWindowUpdate, flagFIN, st.id, 0, nil, func() bool {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if st.finSent || st.reset {
+			return false
+		}
+		st.finSent = true
+		st.notify()
+		done = st.remoteFIN
+		return true
+	})
+	if done {
+		st.sess.removeStream(st)
+	}
+	if err != nil {
+		return st.opErr("close", err)
+	}
+	return nil
+}
+
+// sendReset resets the stream.
+func (st *Stream) sendReset() error {
+	err := st.sess.send(frameWindowUpdate, flagRST, st.id, 0, nil, func() bool {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if st.reset {
+			return false
+		}
+		st.reset = true
+		st.recv.Reset()
+		st.notify()
+		return true
+	})
+	st.sess.removeStream(st)
+	if err != nil {
+		return st.opErr("reset", err)
+	}
+	return nil
+}
+
+// recvData handles a data frame sent by the remote side.
+func (st *Stream) recvData(flags uint16, body []byte) error {
+	st.mu.Lock()
+	if len(body) > 0 {
+		if st.remoteFIN || uint32(len(body)) > st.recvWindow {
+			st.mu.Unlock()
+			return errProtocol
+		}
+		if st.closed {
+			// The data will never be read, so reset the stream.
+			st.mu.Unlock()
+			go st.sendReset()
+			return nil
+		}
+		st.recvWindow -= uint32(len(body))
+		st.recv.Write(body)
+	}
+	st.mu.Unlock()
+	return st.recvFlags(flags)
+}
+
+// recvWindowUpdate handles a window update frame sent by the remote
+// side.
+func (st *Stream) recvWindowUpdate(flags uint16, delta uint32) error {
+	st.mu.Lock()
+	st.sendWindow += delta
+	st.mu.Unlock()
+	return st.recvFlags(flags)
+}
+
+// recvFlags handles the flags of a frame sent by the remote side and
+// wakes up the operations waiting on the stream.
+func (st *Stream) recvFlags(flags uint16) error {
+	st.mu.Lock()
+	if flags&flagFIN != 0 {
+		st.remoteFIN = true
+	}
+	if flags&flagRST != 0 {
+		st.reset = true
+		st.recv.Reset()
+	}
+	done := st.reset || (st.remoteFIN && st.finSent)
+	st.notify()
+	st.mu.Unlock()
+
+	if done {
+		st.sess.removeStream(st)
+	}
+	return nil
+}
+
+// SetDeadline implements the net.Conn SetDeadline method.
+func (st *Stream) SetDeadline(t time.Time) error {
+	if err := st.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return st.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements the net.Conn SetReadDeadline method.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements the net.Conn SetWriteDeadline method.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.writeDeadline.set(t)
+	return nil
+}
+
+// opErr wraps err as a *net.OpError with the stream's address
+// information.
+func (st *Stream) opErr(op string, err error) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    "mux",
+		Source: st.LocalAddr(),
+		Addr:   st.RemoteAddr(),
+		Err:    err,
+	}
+}